@@ -3,9 +3,9 @@ package fetchers
 import (
 	"context"
 	"fmt"
+	"time"
 
 	"github.com/heetch/datablocks/pkg/datablocks"
-	"github.com/heetch/universe/src/services/pickup-experience/core/internal/composer"
 )
 
 // Produce contains the information for a given product in the store
@@ -17,47 +17,39 @@ type Product struct {
 	Price       int64
 }
 
-// ProductAsynReq prepares a function that conforms to the
-// `DataFetcherFn` data type by preparing a closure on the
-// input params. It also prepares a "hash" or unique ID for
-// this function call (and params) so the datafecher can
-// maintain a local temporary cache for the result.
-func ProductAsyncReq(productID string) *composer.AsyncFetchReq {
-	ad := composer.AsyncFetchReq{
-		Fetcher: func(c context.Context) (interface{}, error) {
-			// here we should fetch the required data, now we fake it
-			return Product{
-				Sku:         "1",
+// productsBatcher groups the requests of products in a single
+// call to the products service
+var productsBatcher = datablocks.NewBatcher("Product",
+	func(c context.Context, productIDs []string) (map[string]*Product, error) {
+		// here we should fetch the required data, now we fake it
+		products := make(map[string]*Product, len(productIDs))
+		for _, productID := range productIDs {
+			products[productID] = &Product{
+				Sku:         productID,
 				Name:        "a book",
 				ImageURL:    "https//www.example.com/img1.jpg",
 				Description: "beautiful book",
-			}, nil
-		},
-		Hash: fmt.Sprintf("Product_%s", productID),
-	}
-	return &ad
-}
+			}
+		}
+		return products, nil
+	},
+	datablocks.BatchConf{Window: 2 * time.Millisecond, MaxSize: 50})
 
-// ToProduct is a helper function to cast the interface{}
-// result from ProductAsyncReq to the typed struct.
-func ToProduct(d *datablocks.AsyncFetchData) (*Product, error) {
-	if d == nil {
-		return nil, fmt.Errorf("cannot cast nil value")
-	}
-	out, ok := d.Result.(*Customer)
-	if !ok {
-		return nil, fmt.Errorf("cannot cast")
-	}
-	return out, nil
+// ProductAsynReq prepares a typed fetch request for a product, with
+// the "hash" or unique ID "Product_<productID>" so the datafecher can
+// maintain a local temporary cache for the result. The products
+// requested at the same time are fetched in batches.
+func ProductAsyncReq(productID string) *datablocks.FetchReq[*Product] {
+	return productsBatcher.Req(productID)
 }
 
 // ProductList returns a list of products
 type ProductList []Product
 
 // RelatedProductsAsynReq .
-func RelatedProductsAsyncReq(productID string) *composer.AsyncFetchReq {
-	ad := composer.AsyncFetchReq{
-		Fetcher: func(c context.Context) (interface{}, error) {
+func RelatedProductsAsyncReq(productID string) *datablocks.FetchReq[ProductList] {
+	return datablocks.NewFetchReq(fmt.Sprintf("RelatedProducts_%s", productID),
+		func(c context.Context) (ProductList, error) {
 			// here we should fetch the required data, now we fake it
 			return ProductList{
 				Product{
@@ -73,21 +65,5 @@ func RelatedProductsAsyncReq(productID string) *composer.AsyncFetchReq {
 					Description: "a pencil to take notes",
 				},
 			}, nil
-		},
-		Hash: fmt.Sprintf("Product_%s", productID),
-	}
-	return &ad
-}
-
-// ToProductList is a helper function to cast the interface{}
-// result from ProductAsyncReq to the typed struct.
-func ToProductList(d *datablocks.AsyncFetchData) (*Product, error) {
-	if d == nil {
-		return nil, fmt.Errorf("cannot cast nil value")
-	}
-	out, ok := d.Result.([]ProductList)
-	if !ok {
-		return nil, fmt.Errorf("cannot cast")
-	}
-	return out, nil
+		})
 }
@@ -4,17 +4,17 @@ import (
 	"context"
 	"fmt"
 
-	"github.com/heetch/universe/src/services/pickup-experience/core/internal/composer"
-	"github.com/heetch/universe/src/services/pickup-experience/core/internal/domain/phasingmoder/fetchers"
+	"github.com/heetch/datablocks/examples/fakeshop/fetchers"
+	"github.com/heetch/datablocks/pkg/datablocks"
 )
 
 // CustomerNodeBuilder returns a function of type `NodeBuilderFn`
 // making a closure with the input params
-func CustomerNodeBuilder(customerID string) composer.NodeBuilderFn {
-	return func(ctx context.Context, df composer.DataFetcher) (interface{}, error) {
+func CustomerNodeBuilder(customerID string) datablocks.NodeBuilderFn {
+	return func(ctx context.Context, df datablocks.DataFetcher) (interface{}, error) {
 		// this is an example of not waiting immediately for the result
 		// of a fetch rfequest
-		c, err := df.Fetch(fetchers.CustomerAsyncReq(customerID))
+		c, err := df.Fetch(ctx, &fetchers.CustomerAsyncReq(customerID).AsyncFetchReq)
 
 		if err != nil {
 			return nil, err
@@ -24,10 +24,12 @@ func CustomerNodeBuilder(customerID string) composer.NodeBuilderFn {
 
 		// We want the node builders to be cancellable:
 		select {
-		case res := <-orderChan:
-			// here we need to cast the Result to the proper type to work
-			// with it
-			return res.Result, res.Err
+		case res := <-c:
+			if res.Err != nil {
+				return nil, res.Err
+			}
+			// the result is cast to the type returned by the typed request
+			return datablocks.ResultAs[*fetchers.Customer](res)
 		case <-ctx.Done():
 			return nil, fmt.Errorf("ctx cancelled")
 		}
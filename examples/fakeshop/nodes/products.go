@@ -2,33 +2,39 @@ package nodes
 
 import (
 	"context"
-	"fmt"
 
-	"github.com/heetch/universe/src/services/pickup-experience/core/internal/composer"
-	"github.com/heetch/universe/src/services/pickup-experience/core/internal/domain/phasingmoder/fetchers"
+	"github.com/heetch/datablocks/examples/fakeshop/fetchers"
+	"github.com/heetch/datablocks/pkg/datablocks"
 )
 
 // ProductsNodeBuilder returns a function of type `NodeBuilderFn`
-// making a closure with the input params
-func ProductsNodeBuilder(customerID string) composer.NodeBuilderFn {
-	return func(ctx context.Context, df composer.DataFetcher) (interface{}, error) {
-		f, err := df.WaitForFetch(ctx, fetchers.OrderAsyncReq(orderID))
+// that depends on the "order" node
+func ProductsNodeBuilder() datablocks.NodeBuilderFn {
+	return func(ctx context.Context, df datablocks.DataFetcher) (interface{}, error) {
+		o, err := datablocks.Dependency[*fetchers.Order](ctx, "order")
 		if err != nil {
 			return nil, err
 		}
 
-		o, err := fetchers.ToOrder(f)
-		if err != nil {
-			return nil, err
+		// we launch all the requests before waiting for them, so
+		// they are fetched in a single batch
+		reqs := make([]*datablocks.FetchReq[*fetchers.Product], 0, len(o.ProductIDs))
+		for _, productID := range o.ProductIDs {
+			req := fetchers.ProductAsyncReq(productID)
+			if _, err := df.Fetch(ctx, &req.AsyncFetchReq); err != nil {
+				return nil, err
+			}
+			reqs = append(reqs, req)
 		}
 
-		f, err = df.WaitForFetch(fetchers.ProductAsyncReq(o.LegacyProductID))
-		if err != nil {
-			return nil, err
-		}
-		if f.Err != nil {
-			return nil, fmt.Errorf("cannot fetch the data")
+		products := make([]*fetchers.Product, 0, len(reqs))
+		for _, req := range reqs {
+			p, err := datablocks.WaitFor(ctx, df, req)
+			if err != nil {
+				return nil, err
+			}
+			products = append(products, p)
 		}
-		return f.Result, nil
+		return products, nil
 	}
 }
@@ -4,11 +4,11 @@ import (
 	"context"
 	"fmt"
 
-	"github.com/heetch/universe/src/services/pickup-experience/core/internal/composer"
+	"github.com/heetch/datablocks/pkg/datablocks"
 )
 
-func SuggestionsBuilder(customerID string) composer.NodeBuilderFn {
-	return func(c *context.Context, df DataFetchder) (interface{}, error) {
+func SuggestionsBuilder(customerID string) datablocks.NodeBuilderFn {
+	return func(c context.Context, df datablocks.DataFetcher) (interface{}, error) {
 		return nil, fmt.Errorf("no implemented")
 	}
 }
@@ -5,112 +5,121 @@ import (
 	"fmt"
 	"time"
 
-	"github.com/heetch/universe/src/services/pickup-experience/core/internal/datablocks"
-	"github.com/heetch/universe/src/services/pickup-experience/core/internal/datablocks/nodes"
+	"github.com/heetch/datablocks/examples/fakeshop/fetchers"
+	"github.com/heetch/datablocks/examples/fakeshop/nodes"
+	"github.com/heetch/datablocks/pkg/datablocks"
 )
 
 type FakeDependenciesThing struct {
 	// here we need to put something regarding
 	// how to pass dependencies for the fetching function
-}
-
-// GetStorefrontModel returns all the phasingmodel result
-func GetStorefrontModel(ctx context.Context, userID string,
-	deps *FakeDependenciesThing) (map[string]interface{}, error) {
-
-	storageKey := fmt.Sprintf("ride.pickupxp.phasingmodel.%s", params.OrderID)
-	// with the info or objects from deps, we create a redis keyval storage,
-	// and from the input params w
-	storage := datablocks.NewRedisKeyValStorage()
-
-	// we "hint" the data fetcher to use the number of nodes as the
-	// maximum number of buffer for the chan responses, as we assume
-	// no NodeBuilder will try to fetch twice the same data
-	dataFetcher := datablocks.NewDataFetcherImpl(len(nodesConf))
-
-	// using the dependencies (grpc services to call, etc..), we build
-	// the nodes and the fetcher functions:
-	nodesConf := GetStorefrontNodesConf(deps)
-
-	// we can setup a timeout for building the nodes, is not a global timeout
-	// where we cancel all the response, is just a way to cut the time and
-	// get all the nodes that could be fetched in that time (we should decide
-	// if is good to maintain it or not)
 
-	buildingNodesTimoutMs := 200
-	rb := NewResponseBuilder(storageKey, storage, dataFetcher, nodesConf,
-		buildingNodesTimoutMs)
+	// Storage is shared across requests, so its pool of
+	// connections is reused.
+	Storage *datablocks.RedisKeyValStorage
 
-	// we create a couple of buffered chans to receive the notifications
-	// when the required nodes are ready (or are not going to be ready
-	// because one already failed), and a notification when all the fetching
-	// process has finished (that can be with all nodes ready, or only some
-	// of them)
-	reqReady := make(chan bool, 1)
-	fullReady := make(chan bool, 1)
+	// Fetches is shared across requests too, so concurrent requests
+	// for the same customer only call the customer service once:
+	// 	datablocks.NewSharedFetcher(datablocks.SharedFetchConf{
+	// 		TTLs: map[string]time.Duration{"Customer": time.Second},
+	// 	})
+	Fetches *datablocks.SharedFetcher
 
-	// we launch the background ru
-	rb.Build(context.Background(), reqReady, fullReady)
-
-	// Attention here, because if we want to give some time to
-	// dynamic and optional nodes to be built, we have to put
-	// a timeout (because static nodes will be cached, and dynamic
-	// ones will never be, so usually dynamic request will take longer
-	// to complete)
-	timeout := time.After(time.Millisecond * time.Duration(250))
+	// Builds is shared across requests, so a burst of requests for the
+	// same customer builds the static nodes only once
+	Builds *datablocks.BuildCoordinator
+}
 
-	select {
-	case readyRes := <-reqReady:
-		if !readyRes {
-			return nil, fmt.Errorf("failed to fetch required nodes")
-		}
-	case <-time.After(time.Millisecond * time.Duration(300)):
-		// this time is different, because we want to give more
-		// time for the required nodes to finish, than the optional
-		return nil, t.Errorf("time expired")
-	}
+// GetStorefrontModel returns all the phasingmodel result
+func GetStorefrontModel(ctx context.Context, customerID string,
+	deps *FakeDependenciesThing) (map[string]interface{}, error) {
 
-	// here we know that we allow some time for the optional stuff
-	select {
-	case <-fullReady:
-		// at this point we do not care if all optional nodes are there
-		// or not but we could have a metric for this
-	case <-timeout:
-		// in this case, we dont care if we could not finish
-		return
+	rb, err := datablocks.NewResponseBuilderWithConfig(
+		// the redis keyval storage is created once at startup, with something like:
+		// 	datablocks.NewRedisKeyValStorage(datablocks.RedisConf{Addr: "redis:6379"})
+		deps.Storage,
+		datablocks.BuilderConfig{
+			StorageKey: fmt.Sprintf("shop.storefront.%s", customerID),
+			// using the dependencies (grpc services to call, etc..), we build
+			// the nodes and the fetcher functions:
+			Nodes: GetStorefrontNodesConf(customerID, deps),
+
+			// the timeout for building each node, is not a global timeout
+			// where we cancel all the response, is just a way to cut the time and
+			// get all the nodes that could be fetched in that time
+			NodeTimeout: 200 * time.Millisecond,
+
+			// we give more time for the required nodes to finish, than the optional
+			RequiredDeadline: 300 * time.Millisecond,
+
+			// Attention here, because if we want to give some time to
+			// dynamic and optional nodes to be built, we have to put
+			// a grace period (because static nodes will be cached, and dynamic
+			// ones will never be, so usually dynamic request will take longer
+			// to complete)
+			GracePeriod: 50 * time.Millisecond,
+
+			DataFetcher: datablocks.NewDataFetcherImplWithShared(0, deps.Fetches),
+			Coordinator: deps.Builds,
+
+			// and across replicas, only one of them builds the static nodes
+			// for a customer not in the storage, the rest wait for it a bit
+			BuildLock: datablocks.BuildLockConf{
+				TTL:  time.Second,
+				Wait: 100 * time.Millisecond,
+			},
+		})
+	if err != nil {
+		// the nodes configuration is wrong (i.e: a dependency cycle)
+		return nil, err
 	}
 
-	// we get the response
-	return rb.Result(), nil
+	// it returns an error when some required node could not be built
+	return rb.Build(ctx)
 }
 
 // GetSorefrontNodesConf creates the configuration for the response for
 // a storefront commerce.
-func GetStorefrontNodesConf(customerID string, deps FakeDependenciesThing) ([]datablocks.NodeConf, err) {
+func GetStorefrontNodesConf(customerID string, deps *FakeDependenciesThing) []datablocks.NodeConf {
 	return []datablocks.NodeConf{
 		datablocks.NodeConf{
 			Key:      "customer",
 			Static:   true,
 			Required: true,
 			Builder:  nodes.CustomerNodeBuilder(customerID),
+			// the customer profile is fast, we do not wait long for it
+			Timeout: 80 * time.Millisecond,
+			// so the cached node is restored as a *fetchers.Customer
+			NewResult: datablocks.NewResultOf[*fetchers.Customer](),
 		},
 		datablocks.NodeConf{
-			Key:      "order",
-			Static:   true,
-			Required: false,
-			Builder:  nodes.OrderNodeBuilder(customerID),
+			Key:       "order",
+			Static:    true,
+			Required:  false,
+			Builder:   nodes.OrderNodeBuilder(customerID),
+			NewResult: datablocks.NewResultOf[*fetchers.Order](),
 		},
 		datablocks.NodeConf{
 			Key:      "suggestions",
 			Static:   false,
 			Required: false,
-			Builder:  nodes.SuggestionsNodeBuilder(customerID),
+			Builder:  nodes.SuggestionsBuilder(customerID),
+			// suggestions are slow to compute, serve the previous
+			// ones while they are rebuilt
+			Timeout:      500 * time.Millisecond,
+			StaleAllowed: true,
+			MaxStaleness: time.Hour,
+			// the clients expect a list, even if it is empty
+			Fallback: []string{},
 		},
 		datablocks.NodeConf{
 			Key:      "products",
 			Static:   true,
 			Required: false,
-			Builder:  nodes.ProductNodeBuilder(customerID),
+			// it is built with the result of the order node
+			DependsOn: []string{"order"},
+			Builder:   nodes.ProductsNodeBuilder(),
+			NewResult: datablocks.NewResultOf[[]*fetchers.Product](),
 		},
-	}, nil
+	}
 }
@@ -0,0 +1,200 @@
+package datablocks
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultBatchWindow time.Duration = 5 * time.Millisecond
+)
+
+// ErrNotInBatch is the error for an item that was not returned by
+// the batch fetcher
+var ErrNotInBatch = errors.New("item not returned by the batch fetcher")
+
+// BatchConf holds the configuration for a Batcher
+type BatchConf struct {
+	// Window is the time the items are collected once the first one of a
+	// batch is requested (DefaultBatchWindow if 0)
+	Window time.Duration
+	// MaxSize dispatches the batch as soon as it has MaxSize items,
+	// without waiting for the window to finish (0 means no limit)
+	MaxSize int
+}
+
+// Batcher groups the fetches of individual items into batches, for the
+// services that can fetch several items at once (i.e: products by id).
+//
+// Each item is requested with its own FetchReq (see Req), so it is cached
+// by the DataFetcher with its own hash as any other fetch. The items
+// requested within the batch window are fetched with a single call to
+// the batch fetcher, and its results fanned out to each request. To
+// batch the items, they must be requested with Fetch before waiting
+// for any of them.
+//
+// The batch fetcher is called with a context that keeps the values of the
+// context of the first item of the batch, has the latest deadline of the
+// items, and is cancelled when all of them leave.
+//
+// The items do not wait for a slot in the FetchLimiter of the DataFetcher,
+// that would limit the size of the batches, each batch waits for one in
+// the limiter of the Batcher instead (see SetLimiter).
+type Batcher[T any] struct {
+	batchKey string
+	fetcher  func(ctx context.Context, ids []string) (map[string]T, error)
+	conf     BatchConf
+	limiter  *FetchLimiter
+
+	mut     sync.Mutex
+	pending *batch[T] // the batch collecting items, nil if none
+}
+
+// batch is a group of items fetched with a single call
+type batch[T any] struct {
+	ctx        *fetchContext
+	waiters    int // items whose context is not done
+	ids        []string
+	seen       map[string]bool
+	timer      *time.Timer
+	dispatched bool
+
+	done chan struct{} // closed once res and err are set
+	res  map[string]T
+	err  error
+}
+
+// NewBatcher creates a Batcher. The batchKey is used as the prefix for
+// the hashes of the items (and their family, see AsyncFetchReq), and
+// fetcher is called with the ids of a batch, returning the found items
+// by their id.
+func NewBatcher[T any](batchKey string,
+	fetcher func(ctx context.Context, ids []string) (map[string]T, error),
+	conf BatchConf) *Batcher[T] {
+
+	if conf.Window <= 0 {
+		conf.Window = DefaultBatchWindow
+	}
+	return &Batcher[T]{
+		batchKey: batchKey,
+		fetcher:  fetcher,
+		conf:     conf,
+	}
+}
+
+// SetLimiter sets the FetchLimiter (usually the one of the DataFetcher)
+// used to limit the calls to the batch fetcher, with the batchKey as
+// their family (nil means no limit). It must be called before requesting
+// any item.
+func (b *Batcher[T]) SetLimiter(limiter *FetchLimiter) {
+	b.limiter = limiter
+}
+
+// Req returns the fetch request for a single item, with the hash
+// "<batchKey>_<id>"
+func (b *Batcher[T]) Req(id string) *FetchReq[T] {
+	req := NewFetchReq(fmt.Sprintf("%s_%s", b.batchKey, id),
+		func(ctx context.Context) (T, error) {
+			return b.load(ctx, id)
+		})
+	req.Family = b.batchKey
+	req.batched = true
+	return req
+}
+
+// load adds the item to the pending batch and waits for its result
+func (b *Batcher[T]) load(ctx context.Context, id string) (T, error) {
+	b.mut.Lock()
+	bt := b.pending
+	if bt != nil && bt.ctx.Err() == nil {
+		bt.ctx.join(ctx)
+	} else {
+		// when all the items of the pending batch left, it is cancelled
+		// and dispatched anyway, so we start a new one
+		bt = &batch[T]{
+			ctx:  newFetchContext(ctx),
+			seen: make(map[string]bool),
+			done: make(chan struct{}),
+		}
+		bt.timer = time.AfterFunc(b.conf.Window, func() { b.dispatch(bt) })
+		b.pending = bt
+	}
+	bt.waiters += 1
+	if !bt.seen[id] {
+		bt.seen[id] = true
+		bt.ids = append(bt.ids, id)
+	}
+	full := b.conf.MaxSize > 0 && len(bt.ids) >= b.conf.MaxSize
+	if full {
+		// the following items go to a new batch
+		b.pending = nil
+	}
+	b.mut.Unlock()
+
+	if full {
+		bt.timer.Stop()
+		go b.dispatch(bt)
+	}
+
+	var zero T
+	select {
+	case <-bt.done:
+	case <-ctx.Done():
+		b.leave(bt, ctx.Err())
+		return zero, ctx.Err()
+	}
+	if bt.err != nil {
+		return zero, bt.err
+	}
+	res, ok := bt.res[id]
+	if !ok {
+		return zero, ErrNotInBatch
+	}
+	return res, nil
+}
+
+// leave removes an item whose context is done from the batch, and
+// cancels the batch if it was the last one
+func (b *Batcher[T]) leave(bt *batch[T], err error) {
+	b.mut.Lock()
+	defer b.mut.Unlock()
+	bt.waiters -= 1
+	if bt.waiters == 0 {
+		bt.ctx.cancel(err)
+	}
+}
+
+// dispatch calls the batch fetcher for a batch, if it was not
+// dispatched yet
+func (b *Batcher[T]) dispatch(bt *batch[T]) {
+	b.mut.Lock()
+	if bt.dispatched {
+		b.mut.Unlock()
+		return
+	}
+	bt.dispatched = true
+	if b.pending == bt {
+		b.pending = nil
+	}
+	ids := bt.ids
+	b.mut.Unlock()
+
+	release, err := b.limiter.acquire(bt.ctx, b.batchKey)
+	var res interface{}
+	if err == nil {
+		res, err = callFetcher(bt.ctx, b.batchKey,
+			func(ctx context.Context) (interface{}, error) {
+				return b.fetcher(ctx, ids)
+			})
+		release()
+	}
+	bt.ctx.cancel(context.Canceled)
+	if err == nil {
+		bt.res, _ = res.(map[string]T)
+	}
+	bt.err = err
+	close(bt.done)
+}
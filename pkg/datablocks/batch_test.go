@@ -0,0 +1,173 @@
+package datablocks
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testBatchFetcher records the batches it is called with, and returns
+// the ids in upper case, except for the "missing" one
+type testBatchFetcher struct {
+	mut     sync.Mutex
+	batches []string
+	err     error
+}
+
+func (f *testBatchFetcher) Fetch(ctx context.Context, ids []string) (map[string]string, error) {
+	sorted := append([]string{}, ids...)
+	sort.Strings(sorted)
+	f.mut.Lock()
+	f.batches = append(f.batches, strings.Join(sorted, ","))
+	f.mut.Unlock()
+	if f.err != nil {
+		return nil, f.err
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	res := make(map[string]string, len(ids))
+	for _, id := range ids {
+		if id != "missing" {
+			res[id] = strings.ToUpper(id)
+		}
+	}
+	return res, nil
+}
+
+func (f *testBatchFetcher) Batches() []string {
+	f.mut.Lock()
+	defer f.mut.Unlock()
+	return append([]string{}, f.batches...)
+}
+
+// fetchBatched fetches all the ids, before waiting for any of them
+func fetchBatched(df DataFetcher, b *Batcher[string], ids ...string) ([]string, []error) {
+	ctx := context.Background()
+	reqs := make([]*FetchReq[string], len(ids))
+	for idx, id := range ids {
+		reqs[idx] = b.Req(id)
+		df.Fetch(ctx, &reqs[idx].AsyncFetchReq)
+	}
+	res := make([]string, len(ids))
+	errs := make([]error, len(ids))
+	for idx, req := range reqs {
+		res[idx], errs[idx] = WaitFor(ctx, df, req)
+	}
+	return res, errs
+}
+
+func Test_BatcherFansOut(t *testing.T) {
+	f := &testBatchFetcher{}
+	b := NewBatcher("Product", f.Fetch, BatchConf{})
+	df := NewDataFetcherImpl(8)
+
+	res, errs := fetchBatched(df, b, "a", "b", "c", "missing")
+	if batches := f.Batches(); len(batches) != 1 || batches[0] != "a,b,c,missing" {
+		t.Errorf("want a single batch, got %v", batches)
+		return
+	}
+	for idx, want := range []string{"A", "B", "C"} {
+		if res[idx] != want || errs[idx] != nil {
+			t.Errorf("item %d, want %s, got %s (%v)", idx, want, res[idx], errs[idx])
+		}
+	}
+	if errs[3] != ErrNotInBatch {
+		t.Errorf("missing item, want ErrNotInBatch, got %v", errs[3])
+	}
+
+	// the items are cached with their own hash
+	fetchBatched(df, b, "a", "d")
+	if batches := f.Batches(); len(batches) != 2 || batches[1] != "d" {
+		t.Errorf("want a batch with the item not cached, got %v", batches)
+	}
+	d, _ := df.WaitForFetch(context.Background(), &b.Req("d").AsyncFetchReq)
+	if d.Hash != "Product_d" || d.Result != "D" {
+		t.Errorf("unexpected cached item %+v", d)
+	}
+}
+
+func Test_BatcherMaxSize(t *testing.T) {
+	f := &testBatchFetcher{}
+	b := NewBatcher("Product", f.Fetch, BatchConf{MaxSize: 2})
+
+	res, _ := fetchBatched(NewDataFetcherImpl(8), b, "a", "b", "c", "d", "e")
+	if batches := f.Batches(); len(batches) != 3 {
+		t.Errorf("batches, want 3, got %v", batches)
+		return
+	}
+	if strings.Join(res, "") != "ABCDE" {
+		t.Errorf("unexpected results %v", res)
+	}
+}
+
+func Test_BatcherError(t *testing.T) {
+	f := &testBatchFetcher{err: fmt.Errorf("service down")}
+	b := NewBatcher("Product", f.Fetch, BatchConf{})
+
+	_, errs := fetchBatched(NewDataFetcherImpl(8), b, "a", "b")
+	for _, err := range errs {
+		if err != f.err {
+			t.Errorf("want the batch error, got %v", err)
+		}
+	}
+}
+
+func Test_BatcherFirstItemLeaves(t *testing.T) {
+	f := &testBatchFetcher{}
+	b := NewBatcher("Product", f.Fetch, BatchConf{Window: 10 * time.Millisecond})
+	df := NewDataFetcherImpl(8)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	df.Fetch(ctx, &b.Req("a").AsyncFetchReq)
+	req := b.Req("b")
+	df.Fetch(context.Background(), &req.AsyncFetchReq)
+	// both items are in the batch before the first one leaves
+	time.Sleep(2 * time.Millisecond)
+	cancel()
+
+	// the batch goes on for the items still waiting
+	res, err := WaitFor(context.Background(), df, req)
+	if err != nil || res != "B" {
+		t.Errorf("want B, got %s (%v)", res, err)
+		return
+	}
+	if batches := f.Batches(); len(batches) != 1 || batches[0] != "a,b" {
+		t.Errorf("want a single batch, got %v", batches)
+	}
+}
+
+func Test_BatcherLimiter(t *testing.T) {
+	var tracker concurrencyTracker
+	f := &testBatchFetcher{}
+	fetcher := func(ctx context.Context, ids []string) (map[string]string, error) {
+		tracker.run(10 * time.Millisecond)
+		return f.Fetch(ctx, ids)
+	}
+	limiter := NewFetchLimiter(FetchLimits{PerFamily: map[string]int{"Product": 1}})
+	b := NewBatcher("Product", fetcher, BatchConf{MaxSize: 4})
+	b.SetLimiter(limiter)
+	df := NewDataFetcherImpl(8)
+	df.SetLimiter(limiter)
+
+	// the items do not take a slot, so they are batched
+	_, errs := fetchBatched(df, b, "a", "b", "c", "d", "e", "f", "g", "h")
+	for idx, err := range errs {
+		if err != nil {
+			t.Errorf("item %d, unexpected error %s", idx, err.Error())
+			return
+		}
+	}
+	if batches := f.Batches(); len(batches) != 2 {
+		t.Errorf("want 2 batches, got %v", batches)
+		return
+	}
+	if tracker.Max() != 1 {
+		t.Errorf("concurrent batches, want 1, got %d", tracker.Max())
+	}
+}
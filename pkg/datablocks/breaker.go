@@ -0,0 +1,395 @@
+package datablocks
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultBreakerWindow       time.Duration = 10 * time.Second
+	DefaultBreakerMinRequests  int           = 10
+	DefaultBreakerFailureRatio float64       = 0.5
+	DefaultBreakerOpenTimeout  time.Duration = 5 * time.Second
+	DefaultBreakerProbes       int           = 1
+)
+
+// ErrCircuitOpen is the error for the calls rejected by an open circuit
+// breaker. The returned errors wrap it with the name of the breaker, so
+// they must be checked with errors.Is.
+var ErrCircuitOpen = errors.New("circuit open")
+
+// CircuitState is the state of a CircuitBreaker
+type CircuitState int
+
+const (
+	// CircuitClosed lets all the calls go through
+	CircuitClosed CircuitState = iota
+	// CircuitOpen rejects all the calls with ErrCircuitOpen
+	CircuitOpen
+	// CircuitHalfOpen lets a few probe calls go through, to decide if
+	// the circuit is closed again
+	CircuitHalfOpen
+)
+
+func (s CircuitState) String() string {
+	switch s {
+	case CircuitClosed:
+		return "closed"
+	case CircuitOpen:
+		return "open"
+	case CircuitHalfOpen:
+		return "half_open"
+	}
+	return "unknown"
+}
+
+// BreakerConf holds the configuration for a CircuitBreaker
+type BreakerConf struct {
+	// The circuit opens when, in a Window (DefaultBreakerWindow if 0),
+	// there have been at least MinRequests calls (DefaultBreakerMinRequests
+	// if 0) and the ratio of failed ones is at least FailureRatio
+	// (DefaultBreakerFailureRatio if 0)
+	Window       time.Duration
+	MinRequests  int
+	FailureRatio float64
+
+	// OpenTimeout is the time the circuit stays open before letting
+	// Probes calls go through (DefaultBreakerOpenTimeout and
+	// DefaultBreakerProbes if 0): if all of them succeed the circuit is
+	// closed, and if one fails it is opened again
+	OpenTimeout time.Duration
+	Probes      int
+
+	// IsFailure tells if a call that returned err counts as failed. When
+	// nil, all the errors count except context.Canceled (the caller left).
+	IsFailure func(err error) bool
+
+	// OnStateChange is optional, and called (with the lock of the breaker
+	// held, so it must not call it) each time the state changes, i.e: to
+	// report metrics
+	OnStateChange func(name string, from, to CircuitState)
+}
+
+// CircuitBreaker stops calling a failing dependency for some time, so
+// the callers fail fast with ErrCircuitOpen instead of waiting for its
+// errors or timeouts.
+type CircuitBreaker struct {
+	name string
+	conf BreakerConf
+
+	mut         sync.Mutex
+	state       CircuitState
+	generation  uint64 // incremented on each state change
+	windowStart time.Time
+	requests    int
+	failures    int
+	openedAt    time.Time
+	probes      int // probes in flight
+	successes   int // successful probes
+}
+
+// NewCircuitBreaker creates a CircuitBreaker, the name is used in its
+// errors and state changes.
+func NewCircuitBreaker(name string, conf BreakerConf) *CircuitBreaker {
+	if conf.Window <= 0 {
+		conf.Window = DefaultBreakerWindow
+	}
+	if conf.MinRequests <= 0 {
+		conf.MinRequests = DefaultBreakerMinRequests
+	}
+	if conf.FailureRatio <= 0 {
+		conf.FailureRatio = DefaultBreakerFailureRatio
+	}
+	if conf.OpenTimeout <= 0 {
+		conf.OpenTimeout = DefaultBreakerOpenTimeout
+	}
+	if conf.Probes <= 0 {
+		conf.Probes = DefaultBreakerProbes
+	}
+	return &CircuitBreaker{
+		name:        name,
+		conf:        conf,
+		windowStart: time.Now(),
+	}
+}
+
+// Name returns the name of the breaker
+func (b *CircuitBreaker) Name() string {
+	return b.name
+}
+
+// State returns the current state of the breaker
+func (b *CircuitBreaker) State() CircuitState {
+	b.mut.Lock()
+	defer b.mut.Unlock()
+	b.refresh(time.Now())
+	return b.state
+}
+
+// Do calls fn if the circuit lets it go through, recording its result,
+// or returns an ErrCircuitOpen error otherwise.
+func (b *CircuitBreaker) Do(fn func() error) error {
+	gen, err := b.before()
+	if err != nil {
+		return err
+	}
+	err = fn()
+	b.after(gen, err)
+	return err
+}
+
+// before checks if a call can go through, and returns the generation
+// to be passed to after (or skip). A nil CircuitBreaker lets all the
+// calls go through.
+func (b *CircuitBreaker) before() (uint64, error) {
+	if b == nil {
+		return 0, nil
+	}
+	b.mut.Lock()
+	defer b.mut.Unlock()
+	b.refresh(time.Now())
+	switch b.state {
+	case CircuitOpen:
+		return 0, fmt.Errorf("%s: %w", b.name, ErrCircuitOpen)
+	case CircuitHalfOpen:
+		if b.probes+b.successes >= b.conf.Probes {
+			return 0, fmt.Errorf("%s: %w", b.name, ErrCircuitOpen)
+		}
+		b.probes += 1
+	default:
+		b.requests += 1
+	}
+	return b.generation, nil
+}
+
+// after records the result of a call allowed by before
+func (b *CircuitBreaker) after(gen uint64, err error) {
+	if b == nil {
+		return
+	}
+	b.record(gen, b.isFailure(err), err == nil)
+}
+
+// skip releases a call allowed by before that was not done
+func (b *CircuitBreaker) skip(gen uint64) {
+	if b == nil {
+		return
+	}
+	b.record(gen, false, false)
+}
+
+// record counts a call, that does not count as a request when it did
+// not fail nor succeed (i.e: the caller left)
+func (b *CircuitBreaker) record(gen uint64, failed, succeeded bool) {
+	b.mut.Lock()
+	defer b.mut.Unlock()
+	if gen != b.generation {
+		// the state changed while the call was running
+		return
+	}
+	switch b.state {
+	case CircuitHalfOpen:
+		b.probes -= 1
+		if failed {
+			b.setState(CircuitOpen, time.Now())
+		} else if succeeded {
+			b.successes += 1
+			if b.successes >= b.conf.Probes {
+				b.setState(CircuitClosed, time.Now())
+			}
+		}
+	case CircuitClosed:
+		if !failed {
+			if !succeeded && b.requests > 0 {
+				b.requests -= 1
+			}
+			return
+		}
+		b.failures += 1
+		if b.requests >= b.conf.MinRequests &&
+			float64(b.failures) >= b.conf.FailureRatio*float64(b.requests) {
+			b.setState(CircuitOpen, time.Now())
+		}
+	}
+}
+
+// isFailure tells if a call that returned err counts as failed
+func (b *CircuitBreaker) isFailure(err error) bool {
+	if err == nil {
+		return false
+	}
+	if b.conf.IsFailure != nil {
+		return b.conf.IsFailure(err)
+	}
+	return !errors.Is(err, context.Canceled)
+}
+
+// refresh moves an open circuit to half open once its timeout is over,
+// and starts a new window for a closed one
+// (must be called with the lock held)
+func (b *CircuitBreaker) refresh(now time.Time) {
+	switch b.state {
+	case CircuitOpen:
+		if now.Sub(b.openedAt) >= b.conf.OpenTimeout {
+			b.setState(CircuitHalfOpen, now)
+		}
+	case CircuitClosed:
+		if now.Sub(b.windowStart) >= b.conf.Window {
+			b.windowStart = now
+			b.requests, b.failures = 0, 0
+		}
+	}
+}
+
+// setState changes the state, resetting the counts
+// (must be called with the lock held)
+func (b *CircuitBreaker) setState(state CircuitState, now time.Time) {
+	from := b.state
+	b.state = state
+	b.generation += 1
+	b.windowStart = now
+	b.requests, b.failures = 0, 0
+	b.probes, b.successes = 0, 0
+	if state == CircuitOpen {
+		b.openedAt = now
+	}
+	if b.conf.OnStateChange != nil {
+		b.conf.OnStateChange(b.name, from, state)
+	}
+}
+
+// CircuitBreakers holds a CircuitBreaker for each family of fetches (see
+// AsyncFetchReq.Family), created on demand with the same configuration.
+// It is usually shared by all the DataFetcherImpl of a process (see
+// DataFetcherImpl.SetBreakers).
+type CircuitBreakers struct {
+	conf BreakerConf
+
+	mut      sync.Mutex
+	breakers map[string]*CircuitBreaker
+}
+
+// NewCircuitBreakers creates a CircuitBreakers
+func NewCircuitBreakers(conf BreakerConf) *CircuitBreakers {
+	return &CircuitBreakers{
+		conf:     conf,
+		breakers: make(map[string]*CircuitBreaker),
+	}
+}
+
+// Breaker returns the breaker of a family, creating it if needed. A nil
+// CircuitBreakers returns a nil breaker, that lets all the calls go
+// through.
+func (g *CircuitBreakers) Breaker(family string) *CircuitBreaker {
+	if g == nil {
+		return nil
+	}
+	g.mut.Lock()
+	defer g.mut.Unlock()
+	b, ok := g.breakers[family]
+	if !ok {
+		b = NewCircuitBreaker(family, g.conf)
+		g.breakers[family] = b
+	}
+	return b
+}
+
+// States returns the state of the breaker of each family
+func (g *CircuitBreakers) States() map[string]CircuitState {
+	g.mut.Lock()
+	breakers := make([]*CircuitBreaker, 0, len(g.breakers))
+	for _, b := range g.breakers {
+		breakers = append(breakers, b)
+	}
+	g.mut.Unlock()
+
+	states := make(map[string]CircuitState, len(breakers))
+	for _, b := range breakers {
+		states[b.name] = b.State()
+	}
+	return states
+}
+
+// BreakerKeyValStorage is a KeyValStorage that calls another one through
+// a CircuitBreaker, so the builders fail fast when the storage is down
+// (and build the nodes as if nothing was stored).
+//
+// The locks (see LockKeyValStorage) are forwarded to the wrapped storage,
+// and fail with ErrLocksNotSupported when it does not implement them.
+type BreakerKeyValStorage struct {
+	storage KeyValStorage
+	breaker *CircuitBreaker
+}
+
+// NewBreakerKeyValStorage creates a BreakerKeyValStorage
+func NewBreakerKeyValStorage(storage KeyValStorage,
+	breaker *CircuitBreaker) *BreakerKeyValStorage {
+
+	return &BreakerKeyValStorage{
+		storage: storage,
+		breaker: breaker,
+	}
+}
+
+func (s *BreakerKeyValStorage) Get(ctx context.Context, key string) ([]byte, error) {
+	var val []byte
+	err := s.breaker.Do(func() error {
+		var err error
+		val, err = s.storage.Get(ctx, key)
+		return err
+	})
+	return val, err
+}
+
+func (s *BreakerKeyValStorage) Set(ctx context.Context, key string, val []byte) error {
+	return s.breaker.Do(func() error {
+		return s.storage.Set(ctx, key, val)
+	})
+}
+
+func (s *BreakerKeyValStorage) SetWithTTL(ctx context.Context, key string, val []byte,
+	ttl time.Duration) error {
+
+	return s.breaker.Do(func() error {
+		return setWithTTL(ctx, s.storage, key, val, ttl)
+	})
+}
+
+func (s *BreakerKeyValStorage) SetNX(ctx context.Context, key string, val []byte,
+	ttl time.Duration) (bool, error) {
+
+	lockStorage, ok := s.storage.(LockKeyValStorage)
+	if !ok {
+		return false, ErrLocksNotSupported
+	}
+	var set bool
+	err := s.breaker.Do(func() error {
+		var err error
+		set, err = lockStorage.SetNX(ctx, key, val, ttl)
+		return err
+	})
+	return set, err
+}
+
+func (s *BreakerKeyValStorage) DelIfEqual(ctx context.Context, key string,
+	val []byte) (bool, error) {
+
+	lockStorage, ok := s.storage.(LockKeyValStorage)
+	if !ok {
+		return false, ErrLocksNotSupported
+	}
+	var deleted bool
+	err := s.breaker.Do(func() error {
+		var err error
+		deleted, err = lockStorage.DelIfEqual(ctx, key, val)
+		return err
+	})
+	return deleted, err
+}
+
+func (s *BreakerKeyValStorage) supportsLocks() bool {
+	return supportsLocks(s.storage)
+}
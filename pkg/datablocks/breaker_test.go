@@ -0,0 +1,203 @@
+package datablocks
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+var errTestDown = errors.New("service down")
+
+func Test_CircuitBreaker(t *testing.T) {
+	var changes []string
+	b := NewCircuitBreaker("Customer", BreakerConf{
+		MinRequests: 4,
+		OpenTimeout: 20 * time.Millisecond,
+		OnStateChange: func(name string, from, to CircuitState) {
+			changes = append(changes, fmt.Sprintf("%s:%s>%s", name, from, to))
+		},
+	})
+
+	failing := func() error { return errTestDown }
+	for i := 0; i < 3; i++ {
+		b.Do(failing)
+	}
+	if b.State() != CircuitClosed {
+		t.Errorf("want closed before min requests, got %s", b.State())
+		return
+	}
+	b.Do(failing)
+	if b.State() != CircuitOpen {
+		t.Errorf("want open, got %s", b.State())
+		return
+	}
+
+	var calls int
+	err := b.Do(func() error { calls += 1; return nil })
+	if !errors.Is(err, ErrCircuitOpen) || calls != 0 {
+		t.Errorf("want to fail fast, got %v and %d calls", err, calls)
+		return
+	}
+
+	// a failed probe opens the circuit again
+	time.Sleep(20 * time.Millisecond)
+	if b.State() != CircuitHalfOpen {
+		t.Errorf("want half open, got %s", b.State())
+		return
+	}
+	b.Do(failing)
+	if b.State() != CircuitOpen {
+		t.Errorf("want open after a failed probe, got %s", b.State())
+		return
+	}
+
+	// a successful one closes it
+	time.Sleep(20 * time.Millisecond)
+	if err := b.Do(func() error { return nil }); err != nil {
+		t.Errorf("unexpected error %s", err.Error())
+		return
+	}
+	if b.State() != CircuitClosed {
+		t.Errorf("want closed after a successful probe, got %s", b.State())
+		return
+	}
+
+	want := "Customer:closed>open Customer:open>half_open Customer:half_open>open " +
+		"Customer:open>half_open Customer:half_open>closed"
+	if got := fmt.Sprint(changes); got != "["+want+"]" {
+		t.Errorf("state changes, want %s, got %s", want, got)
+	}
+}
+
+func Test_CircuitBreakerProbes(t *testing.T) {
+	b := NewCircuitBreaker("Customer", BreakerConf{
+		MinRequests: 1,
+		OpenTimeout: 10 * time.Millisecond,
+		Probes:      2,
+	})
+	b.Do(func() error { return errTestDown })
+	time.Sleep(10 * time.Millisecond)
+
+	// only Probes calls are let through while half open
+	release := make(chan struct{})
+	done := make(chan error, 2)
+	for i := 0; i < 2; i++ {
+		go func() {
+			done <- b.Do(func() error { <-release; return nil })
+		}()
+	}
+	time.Sleep(5 * time.Millisecond)
+	if err := b.Do(func() error { return nil }); !errors.Is(err, ErrCircuitOpen) {
+		t.Errorf("want a rejected call beyond the probes, got %v", err)
+		return
+	}
+	close(release)
+	<-done
+	<-done
+	if b.State() != CircuitClosed {
+		t.Errorf("want closed, got %s", b.State())
+	}
+}
+
+func Test_CircuitBreakerIgnoresCancelled(t *testing.T) {
+	b := NewCircuitBreaker("Customer", BreakerConf{MinRequests: 2})
+	for i := 0; i < 4; i++ {
+		b.Do(func() error { return context.Canceled })
+	}
+	b.Do(func() error { return errTestDown })
+	if b.State() != CircuitClosed {
+		t.Errorf("cancelled calls should not count, got %s", b.State())
+	}
+}
+
+func Test_FetcherCircuitBreakers(t *testing.T) {
+	breakers := NewCircuitBreakers(BreakerConf{MinRequests: 2})
+	df := NewDataFetcherImpl(1)
+	df.SetBreakers(breakers)
+
+	var calls int32
+	fetcher := func(ctx context.Context) (interface{}, error) {
+		atomic.AddInt32(&calls, 1)
+		return nil, errTestDown
+	}
+	for i := 0; i < 3; i++ {
+		res, _ := df.WaitForFetch(context.Background(), &AsyncFetchReq{
+			Hash:    fmt.Sprintf("Customer_%d", i),
+			Fetcher: fetcher,
+		})
+		if i < 2 && res.Err != errTestDown {
+			t.Errorf("fetch %d, want the fetcher error, got %v", i, res.Err)
+			return
+		}
+		if i == 2 && (!errors.Is(res.Err, ErrCircuitOpen) || res.Attempts != 0) {
+			t.Errorf("want to fail fast, got %+v", res)
+			return
+		}
+	}
+	if calls != 2 {
+		t.Errorf("calls, want 2, got %d", calls)
+		return
+	}
+
+	// the other families are not affected
+	res, _ := df.WaitForFetch(context.Background(), &AsyncFetchReq{
+		Hash:    "Product_1",
+		Fetcher: func(ctx context.Context) (interface{}, error) { return "ok", nil },
+	})
+	if res.Err != nil {
+		t.Errorf("unexpected error %s", res.Err.Error())
+		return
+	}
+	states := breakers.States()
+	if states["Customer"] != CircuitOpen || states["Product"] != CircuitClosed {
+		t.Errorf("unexpected states %v", states)
+	}
+}
+
+// failingStorage is a KeyValStorage that is down
+type failingStorage struct {
+	calls int
+}
+
+func (s *failingStorage) Get(ctx context.Context, key string) ([]byte, error) {
+	s.calls += 1
+	return nil, errTestDown
+}
+
+func (s *failingStorage) Set(ctx context.Context, key string, val []byte) error {
+	s.calls += 1
+	return errTestDown
+}
+
+func Test_BreakerKeyValStorage(t *testing.T) {
+	failing := &failingStorage{}
+	s := NewBreakerKeyValStorage(failing,
+		NewCircuitBreaker("storage", BreakerConf{MinRequests: 2}))
+
+	ctx := context.Background()
+	s.Get(ctx, "a")
+	s.SetWithTTL(ctx, "a", []byte("x"), time.Minute)
+	if _, err := s.Get(ctx, "a"); !errors.Is(err, ErrCircuitOpen) {
+		t.Errorf("want a circuit open error, got %v", err)
+		return
+	}
+	if failing.calls != 2 {
+		t.Errorf("calls, want 2, got %d", failing.calls)
+	}
+}
+
+func Test_BreakerKeyValStorageLocks(t *testing.T) {
+	s := NewBreakerKeyValStorage(NewInMemKeyValStorage(),
+		NewCircuitBreaker("storage", BreakerConf{}))
+	testLockStorage(t, s)
+
+	s = NewBreakerKeyValStorage(NewNopKeyValStorage(),
+		NewCircuitBreaker("storage", BreakerConf{}))
+	_, err := s.SetNX(context.Background(), "lock", []byte("a"), time.Minute)
+	if err != ErrLocksNotSupported {
+		t.Errorf("want ErrLocksNotSupported, got %v", err)
+	}
+}
@@ -2,15 +2,121 @@ package datablocks
 
 import (
 	"context"
-	"encoding/json"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
 	"sync"
 	"time"
 )
 
 const (
-	DefaultBuildNodeTimeoutMillis int = 2000
+	DefaultBuildNodeTimeoutMillis int           = 2000
+	DefaultBuildLockPollInterval  time.Duration = 10 * time.Millisecond
+	DefaultStorageWriteTimeout    time.Duration = time.Second
 )
 
+// ErrBuildStarted is returned by Build when the response builder
+// was already started
+var ErrBuildStarted = errors.New("response builder already started")
+
+// ErrNodeNotReady is the error for a required node that was still
+// being built when Build stopped waiting for it
+var ErrNodeNotReady = errors.New("node not ready")
+
+// ErrBuildLocked is the error for an optional static node that was not
+// built because another builder holds the build lock (see BuildLockConf)
+var ErrBuildLocked = errors.New("node built by another builder")
+
+// RequiredNodesError is returned by Build when one or more required
+// nodes could not be built
+type RequiredNodesError struct {
+	// Errs has the error for each failed required node
+	Errs map[string]error
+}
+
+func (e *RequiredNodesError) Error() string {
+	keys := make([]string, 0, len(e.Errs))
+	for k := range e.Errs {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var b strings.Builder
+	b.WriteString("required nodes failed:")
+	for _, k := range keys {
+		fmt.Fprintf(&b, " %s: %s;", k, e.Errs[k].Error())
+	}
+	return strings.TrimSuffix(b.String(), ";")
+}
+
+// BuilderConfig holds all the configuration to create a ResponseBuilder
+// with NewResponseBuilderWithConfig
+type BuilderConfig struct {
+	// StorageKey must be unique for a given (phase / state) set
+	StorageKey string
+	Nodes      []NodeConf
+
+	// NodeTimeout is the maximum time a node builder can take to return
+	// its response (0 uses DefaultBuildNodeTimeoutMillis, and a negative
+	// value disables it)
+	NodeTimeout time.Duration
+
+	// RequiredDeadline is the maximum time Build waits for the required
+	// nodes (0 means it waits until the context is done)
+	RequiredDeadline time.Duration
+	// GracePeriod is the extra time Build waits for the optional nodes
+	// once the required ones are ready (0 means it does not wait)
+	GracePeriod time.Duration
+
+	StorageTTL time.Duration
+	Codec      Codec
+
+	// DataFetcher is optional, a DataFetcherImpl is created if nil
+	DataFetcher DataFetcher
+
+	// Coordinator is optional, to share the build of the static nodes
+	// with the other builders with the same StorageKey
+	Coordinator *BuildCoordinator
+
+	// BuildLock is optional, to share the build of the static nodes with
+	// the builders in other processes
+	BuildLock BuildLockConf
+
+	// MaxParallelNodes is the maximum number of nodes built at the same
+	// time, the rest wait for their turn (0 means no limit)
+	MaxParallelNodes int
+
+	// StorageWriteTimeout is the maximum time to save the nodes and release
+	// the build lock once the build finishes (DefaultStorageWriteTimeout
+	// if 0)
+	StorageWriteTimeout time.Duration
+}
+
+// BuildLockConf configures the build lock, that makes only one builder,
+// across all the processes using the same storage, build the static nodes
+// for a storage key that are missing from the storage. It requires a
+// storage that implements LockKeyValStorage, NewResponseBuilderWithConfig
+// fails with ErrLocksNotSupported otherwise.
+//
+// The other builders wait for the lock holder to save the static nodes
+// (that it does once they are built, without waiting for its dynamic
+// nodes), and when they are not saved in time, they build the required ones and
+// skip the optional ones (that fail with ErrBuildLocked). They never save
+// the static nodes, the lock holder does it.
+type BuildLockConf struct {
+	// TTL is the expiration of the lock, in case its holder never releases
+	// it, and should be longer than the time to build the static nodes
+	// (0 disables the lock)
+	TTL time.Duration
+	// Wait is the maximum time waiting for the lock holder to save the
+	// static nodes, that are polled every PollInterval
+	// (DefaultBuildLockPollInterval if 0)
+	Wait         time.Duration
+	PollInterval time.Duration
+}
+
 // ResponseBuilder builds an response from the output
 // of one or more node builders
 type ResponseBuilder struct {
@@ -24,6 +130,7 @@ type ResponseBuilder struct {
 
 	numReqPending int // required fields that are remaining to fetch
 	numReqErr     int // required nodes we could not fetch
+	numReqStale   int // required nodes we could not fetch, with a stale value
 	numOptPending int // optional fields that are remaining to fetch
 	numOptErr     int // optional nodes we could not fetch
 
@@ -35,8 +142,43 @@ type ResponseBuilder struct {
 
 	buildNodeTimeoutMillis int
 
+	// requiredDeadline and gracePeriod are only used by Build
+	requiredDeadline time.Duration
+	gracePeriod      time.Duration
+
+	// storageTTL is the expiration for the static nodes saved to storage,
+	// 0 means no expiration
+	storageTTL time.Duration
+
+	// storageWriteTimeout is the timeout to save the nodes and release
+	// the build lock, see SetStorageWriteTimeout
+	storageWriteTimeout time.Duration
+
+	// codec is used for the nodes that do not have their own codec
+	codec Codec
+
+	// coordinator is optional, see SetCoordinator
+	coordinator *BuildCoordinator
+
+	// buildLock is the build lock configuration, see SetBuildLock.
+	// lockToken is set when we hold the lock, and lockWait when another
+	// builder holds it: it is closed once lockStored has the static nodes
+	// the other builder saved.
+	buildLock  BuildLockConf
+	lockToken  []byte
+	lockWait   chan struct{}
+	lockStored map[string]storedNode
+
+	// nodeSlots limits the nodes built at the same time (nil if there
+	// is no limit), see SetMaxParallelNodes
+	nodeSlots chan struct{}
+
 	// so we can keep stats of how long it took to build all the process
 	buildStartTime time.Time
+	// when the required nodes were built, and when all the nodes finished
+	// (zero until then)
+	requiredReadyAt time.Time
+	fullReadyAt     time.Time
 }
 
 // NodeBuilderResults holds the output for a given NodeConf
@@ -48,6 +190,37 @@ type NodeBuilderResult struct {
 	res      interface{}
 	err      error
 	fetched  bool
+	builtAt  time.Time // when res was built (zero if unknown)
+	// expiresAt is when a node restored from the storage expires there
+	// (zero if it does not expire)
+	expiresAt time.Time
+
+	// source, startedAt, finishedAt and attempts are kept for the
+	// BuildReport
+	source     NodeSource
+	startedAt  time.Time
+	finishedAt time.Time
+	attempts   int
+
+	// stale holds the value from a previous build of a dynamic node that
+	// allows stale values (see NodeConf.StaleAllowed)
+	stale          interface{}
+	staleBuiltAt   time.Time
+	staleExpiresAt time.Time
+	hasStale       bool
+
+	// fallback is set when an optional node with a fallback value fails,
+	// or is not built when Build returns (see NodeConf.Fallback), and it
+	// is computed only once, with fallbackOnce
+	fallback     interface{}
+	hasFallback  bool
+	fallbackOnce sync.Once
+
+	// deps and dependents have the indexes in the result list of the
+	// nodes this one depends on, and the nodes that depend on this one
+	deps        []int
+	dependents  []int
+	pendingDeps int // dependencies that are not built yet
 }
 
 // NewReponseBuilder creates a node builder that can launch parallel
@@ -60,13 +233,16 @@ type NodeBuilderResult struct {
 // 	to return its response: the timeout is required to ensure that some bad
 // 	behaved / stuck node builder causes the build process to not finish.
 //
+// It returns an error if a node depends on an unknown node, or if there
+// is a dependency cycle between the nodes (see *DependencyCycleError).
+//
 // Note:
 // if we want to avoid loading dynamic nodes, because we just want
 // to warm up the storage (i.e: when we receive a kafka event) the caller
 // should take care of removing those nodes from `nodesConf`
 func NewResponseBuilder(storageKey string, storage KeyValStorage,
 	dataFetcher DataFetcher, nodesConf []NodeConf,
-	buildNodeTimeoutMillis int) *ResponseBuilder {
+	buildNodeTimeoutMillis int) (*ResponseBuilder, error) {
 
 	if buildNodeTimeoutMillis < 0 {
 		buildNodeTimeoutMillis = DefaultBuildNodeTimeoutMillis
@@ -85,10 +261,13 @@ func NewResponseBuilder(storageKey string, storage KeyValStorage,
 		// fullReady is passed as param when we launc the build step and can be null
 		// lock does not need initialization
 		buildNodeTimeoutMillis: buildNodeTimeoutMillis,
+		// storageTTL is 0 (no expiration) unless set with SetStorageTTL
+		codec:               DefaultCodec,
+		storageWriteTimeout: DefaultStorageWriteTimeout,
 		// buildStartTime is set at start time
 	}
 
-	exists := make(map[string]bool, len(nodesConf))
+	exists := make(map[string]int, len(nodesConf))
 
 	rb.result = make([]NodeBuilderResult, 0, len(nodesConf))
 	for _, n := range nodesConf {
@@ -98,15 +277,23 @@ func NewResponseBuilder(storageKey string, storage KeyValStorage,
 			// TODO: log a warning of duplicate definition for a node
 			continue
 		} else {
-			exists[n.Key] = true
+			exists[n.Key] = len(rb.result)
 		}
 
 		rb.result = append(rb.result, NodeBuilderResult{
 			nodeConf: NodeConf{
-				Key:      n.Key,
-				Static:   n.Static,
-				Required: n.Required,
-				Builder:  n.Builder,
+				Key:          n.Key,
+				Static:       n.Static,
+				Required:     n.Required,
+				Builder:      n.Builder,
+				Timeout:      n.Timeout,
+				StaleAllowed: n.StaleAllowed && !n.Static,
+				MaxStaleness: n.MaxStaleness,
+				Fallback:     n.Fallback,
+				FallbackFn:   n.FallbackFn,
+				DependsOn:    append([]string(nil), n.DependsOn...),
+				NewResult:    n.NewResult,
+				Codec:        n.Codec,
 			},
 		})
 
@@ -115,17 +302,230 @@ func NewResponseBuilder(storageKey string, storage KeyValStorage,
 		}
 	}
 
+	for idx := range rb.result {
+		r := &rb.result[idx]
+		for _, depKey := range r.nodeConf.DependsOn {
+			depIdx, ok := exists[depKey]
+			if !ok {
+				return nil, fmt.Errorf("node %s depends on unknown node %s",
+					r.nodeConf.Key, depKey)
+			}
+			r.deps = append(r.deps, depIdx)
+			rb.result[depIdx].dependents = append(rb.result[depIdx].dependents, idx)
+		}
+		r.pendingDeps = len(r.deps)
+	}
+	if cycle := rb.findDependencyCycle(); cycle != nil {
+		return nil, &DependencyCycleError{Cycle: cycle}
+	}
+
 	rb.numReqPending = rb.numRequired
 	rb.numOptPending = len(rb.result) - rb.numRequired
-	return rb
+	return rb, nil
 }
 
-// Build launches a background goroutine that takes care of building the model
+// findDependencyCycle returns the keys of the nodes in a dependency
+// cycle, or nil if there are no cycles.
+func (rb *ResponseBuilder) findDependencyCycle() []string {
+	const (
+		unvisited = iota
+		visiting
+		visited
+	)
+	state := make([]int, len(rb.result))
+	path := make([]int, 0, len(rb.result))
+
+	var visit func(idx int) []string
+	visit = func(idx int) []string {
+		state[idx] = visiting
+		path = append(path, idx)
+		for _, depIdx := range rb.result[idx].deps {
+			switch state[depIdx] {
+			case visiting:
+				// the cycle is the part of the path from depIdx
+				var cycle []string
+				for i := len(path) - 1; i >= 0; i-- {
+					cycle = append([]string{rb.result[path[i]].nodeConf.Key}, cycle...)
+					if path[i] == depIdx {
+						break
+					}
+				}
+				return cycle
+			case unvisited:
+				if cycle := visit(depIdx); cycle != nil {
+					return cycle
+				}
+			}
+		}
+		path = path[:len(path)-1]
+		state[idx] = visited
+		return nil
+	}
+
+	for idx := range rb.result {
+		if state[idx] == unvisited {
+			if cycle := visit(idx); cycle != nil {
+				return cycle
+			}
+		}
+	}
+	return nil
+}
+
+// NewResponseBuilderWithConfig creates a response builder from a
+// BuilderConfig (see NewResponseBuilder).
+func NewResponseBuilderWithConfig(storage KeyValStorage,
+	conf BuilderConfig) (*ResponseBuilder, error) {
+
+	if conf.BuildLock.TTL > 0 && !supportsLocks(storage) {
+		return nil, fmt.Errorf("build lock: %w", ErrLocksNotSupported)
+	}
+
+	dataFetcher := conf.DataFetcher
+	if dataFetcher == nil {
+		// we "hint" the data fetcher to use the number of nodes as the
+		// maximum number of buffer for the chan responses
+		dataFetcher = NewDataFetcherImpl(len(conf.Nodes))
+	}
+
+	buildNodeTimeoutMillis := DefaultBuildNodeTimeoutMillis
+	if conf.NodeTimeout < 0 {
+		buildNodeTimeoutMillis = 0
+	} else if conf.NodeTimeout > 0 {
+		// round up, so a sub millisecond timeout does not disable it
+		buildNodeTimeoutMillis = int((conf.NodeTimeout + time.Millisecond - 1) /
+			time.Millisecond)
+	}
+
+	rb, err := NewResponseBuilder(conf.StorageKey, storage, dataFetcher, conf.Nodes,
+		buildNodeTimeoutMillis)
+	if err != nil {
+		return nil, err
+	}
+	rb.requiredDeadline = conf.RequiredDeadline
+	rb.gracePeriod = conf.GracePeriod
+	rb.SetStorageTTL(conf.StorageTTL)
+	rb.SetCodec(conf.Codec)
+	rb.SetCoordinator(conf.Coordinator)
+	rb.SetBuildLock(conf.BuildLock)
+	rb.SetMaxParallelNodes(conf.MaxParallelNodes)
+	rb.SetStorageWriteTimeout(conf.StorageWriteTimeout)
+	return rb, nil
+}
+
+// SetStorageTTL sets the expiration of the static nodes saved under the
+// storageKey: each node expires ttl after it was built, even if the key
+// is saved again with other nodes, and the key itself expires when the
+// storage implements TTLKeyValStorage. It must be called before Build or
+// BuildAsync.
+func (rb *ResponseBuilder) SetStorageTTL(ttl time.Duration) {
+	rb.storageTTL = ttl
+}
+
+// SetCodec sets the codec used to save and restore the static nodes
+// that do not have their own codec (the default is JSONCodec).
+// It must be called before Build or BuildAsync.
+func (rb *ResponseBuilder) SetCodec(codec Codec) {
+	if codec == nil {
+		codec = DefaultCodec
+	}
+	rb.codec = codec
+}
+
+// SetCoordinator sets the BuildCoordinator used to share the build of the
+// static nodes with the other builders with the same storage key (nil
+// disables it). It must be called before Build or BuildAsync.
+func (rb *ResponseBuilder) SetCoordinator(coordinator *BuildCoordinator) {
+	rb.coordinator = coordinator
+}
+
+// SetBuildLock sets the build lock configuration (see BuildLockConf).
+// It has no effect if the storage does not support locks (unlike
+// NewResponseBuilderWithConfig, that fails), and must be called before
+// Build or BuildAsync.
+func (rb *ResponseBuilder) SetBuildLock(conf BuildLockConf) {
+	if conf.PollInterval <= 0 {
+		conf.PollInterval = DefaultBuildLockPollInterval
+	}
+	rb.buildLock = conf
+}
+
+// SetMaxParallelNodes sets the maximum number of nodes built at the
+// same time (<= 0 means no limit). The node timeout of a node starts once
+// it gets its turn, and a node that times out keeps its turn until its
+// builder returns. It must be called before Build or BuildAsync.
+func (rb *ResponseBuilder) SetMaxParallelNodes(n int) {
+	rb.nodeSlots = newSemaphore(n)
+}
+
+// SetStorageWriteTimeout sets the maximum time to save the nodes and
+// release the build lock once the build finishes, that is not bound to
+// the build context (DefaultStorageWriteTimeout if <= 0). It must be
+// called before Build or BuildAsync.
+func (rb *ResponseBuilder) SetStorageWriteTimeout(timeout time.Duration) {
+	if timeout <= 0 {
+		timeout = DefaultStorageWriteTimeout
+	}
+	rb.storageWriteTimeout = timeout
+}
+
+// Build builds the response and blocks until the required nodes are ready,
+// plus the configured grace period for the optional ones, and returns the
+// built nodes (see Result). The optional nodes that are not built by then
+// get their fallback value, if they have one (see NodeConf.Fallback).
+//
+// When a required node fails, or the required deadline expires, it
+// returns the nodes built so far and a *RequiredNodesError.
+// The build of the pending nodes keeps going in the background to save
+// the static nodes in the storage, as long as ctx is not cancelled.
+func (rb *ResponseBuilder) Build(ctx context.Context) (map[string]interface{}, error) {
+	reqReady := make(chan bool, 1)
+	fullReady := make(chan bool, 1)
+	if !rb.start(ctx, reqReady, fullReady) {
+		return nil, ErrBuildStarted
+	}
+
+	var reqDeadline <-chan time.Time
+	if rb.requiredDeadline > 0 {
+		timer := time.NewTimer(rb.requiredDeadline)
+		defer timer.Stop()
+		reqDeadline = timer.C
+	}
+
+	select {
+	case ok := <-reqReady:
+		if !ok {
+			rb.stopWaiting()
+			return rb.Result(), rb.requiredErr()
+		}
+	case <-reqDeadline:
+		rb.stopWaiting()
+		return rb.Result(), rb.requiredErr()
+	case <-ctx.Done():
+		rb.stopWaiting()
+		return rb.Result(), ctx.Err()
+	}
+
+	if rb.gracePeriod > 0 {
+		timer := time.NewTimer(rb.gracePeriod)
+		defer timer.Stop()
+		select {
+		case <-fullReady:
+		case <-timer.C:
+		case <-ctx.Done():
+		}
+	}
+	rb.stopWaiting()
+	return rb.Result(), nil
+}
+
+// BuildAsync launches a background goroutine that takes care of building the model
 // and accepts an optional channel to signal when the required nodes are ready, and
 // another channel to signal when building of the full response has finished.
 //
 // a value of true will be sent through requiredReady when all the required
-//		nodes are build successfully
+//		nodes are build successfully (or have a stale value to serve, see
+//		NodeConf.StaleAllowed)
 // a value of false will be sent through requiredReady as soon as one of the
 //		required nodes failed to build
 //
@@ -134,14 +534,22 @@ func NewResponseBuilder(storageKey string, storage KeyValStorage,
 //		Writing to data might cause data corruption and also migh cause panics.
 // Key/Value pairs can be added to the returned map, as it is not shared (the map,
 // not the other values stored).
-func (rb *ResponseBuilder) Build(ctx context.Context, requiredReady chan<- bool,
+func (rb *ResponseBuilder) BuildAsync(ctx context.Context, requiredReady chan<- bool,
 	fullReady chan<- bool) {
 
+	rb.start(ctx, requiredReady, fullReady)
+}
+
+// start launches the background build, returning false if
+// it was already launched
+func (rb *ResponseBuilder) start(ctx context.Context, requiredReady chan<- bool,
+	fullReady chan<- bool) bool {
+
 	// we use the buildStartTime to know if we are already building the response
 	rb.lock.Lock()
 	if !rb.buildStartTime.IsZero() {
 		rb.lock.Unlock()
-		return
+		return false
 	}
 	rb.buildStartTime = time.Now()
 	rb.lock.Unlock()
@@ -150,90 +558,358 @@ func (rb *ResponseBuilder) Build(ctx context.Context, requiredReady chan<- bool,
 	rb.fullReady = fullReady
 
 	go rb.build(ctx)
+	return true
 }
 
 // Result returns a new map with all the data fetched up to
 // the moment the call is made. The map can be changed by the caller
 // but not the values that it holds (those are shared with the ongoing
 // build process).
+//
+// For the nodes that allow stale values, the value from a previous build
+// is returned while the fresh one is not ready (or if it failed), and
+// for the optional nodes with a fallback value, it is returned if they
+// failed (or are not built when Build returns).
 func (rb *ResponseBuilder) Result() map[string]interface{} {
 	rb.lock.RLock()
 	defer rb.lock.RUnlock()
 
 	// we convert the fetched nodes to a map
 	m := make(map[string]interface{}, len(rb.result))
-	for _, r := range rb.result {
+	now := time.Now()
+	for idx := range rb.result {
+		r := &rb.result[idx]
 		if r.fetched && r.err == nil {
 			m[r.nodeConf.Key] = r.res
+		} else if r.staleValid(now) {
+			m[r.nodeConf.Key] = r.stale
+		} else if r.hasFallback {
+			m[r.nodeConf.Key] = r.fallback
 		}
 	}
 	return m
 }
 
+// Report returns the outcome of the build up to the moment the call is
+// made (see BuildReport).
+func (rb *ResponseBuilder) Report() BuildReport {
+	rb.lock.RLock()
+	defer rb.lock.RUnlock()
+
+	report := BuildReport{
+		StorageKey: rb.storageKey,
+		Start:      rb.buildStartTime,
+		Nodes:      make([]NodeReport, 0, len(rb.result)),
+	}
+	if !rb.requiredReadyAt.IsZero() {
+		report.RequiredReady = true
+		report.RequiredReadyAfter = rb.requiredReadyAt.Sub(rb.buildStartTime)
+	}
+	if !rb.fullReadyAt.IsZero() {
+		report.FullReady = true
+		report.FullReadyAfter = rb.fullReadyAt.Sub(rb.buildStartTime)
+	}
+
+	now := time.Now()
+	for idx := range rb.result {
+		r := &rb.result[idx]
+		n := NodeReport{
+			Key:      r.nodeConf.Key,
+			Required: r.nodeConf.Required,
+			Start:    r.startedAt,
+			End:      r.finishedAt,
+			Attempts: r.attempts,
+		}
+		if r.fetched {
+			n.Status = nodeStatus(r.err)
+			n.Err = r.err
+		}
+		if r.fetched && r.err == nil {
+			n.Source = r.source
+		} else if r.staleValid(now) {
+			n.Source = SourceStale
+		} else if r.hasFallback {
+			n.Source = SourceFallback
+		}
+		report.Nodes = append(report.Nodes, n)
+	}
+	return report
+}
+
+// staleValid returns true if the node has a stale value that is not
+// older than its maximum staleness.
+func (r *NodeBuilderResult) staleValid(now time.Time) bool {
+	if !r.hasStale {
+		return false
+	}
+	if r.nodeConf.MaxStaleness <= 0 {
+		return true
+	}
+	return !r.staleBuiltAt.IsZero() && now.Sub(r.staleBuiltAt) <= r.nodeConf.MaxStaleness
+}
+
+// requiredErr returns a *RequiredNodesError with the required nodes
+// that failed or are not built yet, or nil if all of them are ready.
+func (rb *ResponseBuilder) requiredErr() error {
+	rb.lock.RLock()
+	defer rb.lock.RUnlock()
+
+	errs := map[string]error{}
+	now := time.Now()
+	for idx := range rb.result {
+		r := &rb.result[idx]
+		if !r.nodeConf.Required || (!(r.fetched && r.err == nil) && r.staleValid(now)) {
+			// we can serve a stale value for a required node
+			continue
+		}
+		if !r.fetched {
+			errs[r.nodeConf.Key] = ErrNodeNotReady
+		} else if r.err != nil {
+			errs[r.nodeConf.Key] = r.err
+		}
+	}
+	if len(errs) == 0 {
+		return nil
+	}
+	return &RequiredNodesError{Errs: errs}
+}
+
 // build is the background process that computes the node state
 func (rb *ResponseBuilder) build(ctx context.Context) {
 	// we retrieve all static nodes, updating pending counters
 	rb.fromStorage(ctx)
 
+	// restored nodes are not built again, so they are ready for
+	// the nodes that depend on them
+	for idx := range rb.result {
+		if rb.result[idx].fetched {
+			for _, depIdx := range rb.result[idx].dependents {
+				rb.result[depIdx].pendingDeps -= 1
+			}
+		}
+	}
+
 	if rb.numReqPending == 0 {
+		rb.markReady(true, false)
 		noBlockChanBoolRes(rb.requiredReady, true)
 		if rb.numOptPending == 0 {
+			rb.markReady(false, true)
 			noBlockChanBoolRes(rb.fullReady, true)
 			return
 		}
 	}
 
-	finishedChan := make(chan *NodeBuilderResult, rb.numReqPending+rb.numOptPending)
+	rb.acquireBuildLock(ctx)
 
-	// node builders should respect context cancellation to limit response build time
-	fetchCtx := ctx
-	if rb.buildNodeTimeoutMillis > 0 {
-		c, cancel := context.WithTimeout(fetchCtx,
-			time.Millisecond*time.Duration(rb.buildNodeTimeoutMillis))
-		fetchCtx = c
-		defer cancel()
-	}
+	// nodes can finish at most once, so the chan never blocks
+	finishedChan := make(chan *NodeBuilderResult, len(rb.result))
 
-	// launch the fetch of all parallel nodes
+	// each node gets its own timeout in buildNode, and the pending ones
+	// are cancelled if we stop gathering the results
+	fetchCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	// launch the fetch of all parallel nodes that were not restored and do
+	// not depend on other nodes, the rest will be launched once their
+	// dependencies are built
 	for idx := range rb.result {
-		go rb.buildNode(fetchCtx, &rb.result[idx], finishedChan)
+		if !rb.result[idx].fetched && rb.result[idx].pendingDeps == 0 {
+			go rb.buildNode(fetchCtx, &rb.result[idx], finishedChan)
+		}
 	}
 
+	// the static nodes are saved (and the build lock released) as soon as
+	// they are built, so the builders waiting for them do not wait for
+	// the dynamic nodes too
+	staticSaved := !rb.staticPending()
+
 	// gather all results from parallel buildNode calls
 	cancelled := false
 	for (rb.numReqPending+rb.numOptPending) > 0 && !cancelled {
 		select {
 		case n := <-finishedChan:
-			if n.nodeConf.Required {
-				rb.numReqPending -= 1
-			} else {
-				rb.numOptPending -= 1
-			}
-
-			if n.err != nil {
-				if n.nodeConf.Required {
-					rb.numReqErr += 1
-					if rb.numReqErr == 1 {
-						noBlockChanBoolRes(rb.requiredReady, false)
-					}
-				} else {
-					rb.numOptErr += 1
-				}
-			} else if n.nodeConf.Required && rb.numReqPending == 0 && rb.numReqErr == 0 {
-				// we have all the required data
-				noBlockChanBoolRes(rb.requiredReady, true)
+			// a failed node makes its dependents fail, that are
+			// processed as if they had finished too
+			for finished := []*NodeBuilderResult{n}; len(finished) > 0; {
+				n, finished = finished[0], finished[1:]
+				rb.nodeFinished(n)
+				finished = append(finished,
+					rb.launchDependents(fetchCtx, n, finishedChan)...)
 			}
 			// TODO: decide if we want to keep storing the partial result in storage
 			// rb.toStorage(ctx)
+			if !staticSaved && !rb.staticPending() {
+				rb.saveNodes(ctx)
+				staticSaved = true
+			}
 		case <-ctx.Done():
 			cancelled = true
 		}
 	}
 
-	rb.toStorage(ctx)
 	if rb.numReqPending == 0 && rb.numOptPending == 0 {
-		noBlockChanBoolRes(rb.fullReady, rb.numOptErr == 0 && rb.numReqErr == 0)
+		rb.markReady(false, true)
+	}
+	// the stale values of the dynamic nodes are saved once they are built
+	if !staticSaved || rb.hasStaleAllowed() {
+		rb.saveNodes(ctx)
+	}
+	if rb.numReqPending == 0 && rb.numOptPending == 0 {
+		noBlockChanBoolRes(rb.fullReady,
+			rb.numOptErr == 0 && rb.numReqErr == 0 && rb.numReqStale == 0)
+	}
+}
+
+// staticPending tells if there are static nodes not built yet
+func (rb *ResponseBuilder) staticPending() bool {
+	rb.lock.RLock()
+	defer rb.lock.RUnlock()
+	for idx := range rb.result {
+		if rb.result[idx].nodeConf.Static && !rb.result[idx].fetched {
+			return true
+		}
+	}
+	return false
+}
+
+// hasStaleAllowed tells if there are dynamic nodes that allow stale values
+func (rb *ResponseBuilder) hasStaleAllowed() bool {
+	for idx := range rb.result {
+		if rb.result[idx].nodeConf.StaleAllowed {
+			return true
+		}
+	}
+	return false
+}
+
+// saveNodes saves the nodes to the storage and releases the build lock.
+// The caller usually cancels ctx once Build returns, so they are done
+// with their own timeout instead.
+func (rb *ResponseBuilder) saveNodes(ctx context.Context) {
+	storageCtx, cancel := context.WithTimeout(detachedContext{ctx},
+		rb.storageWriteTimeout)
+	defer cancel()
+	rb.toStorage(storageCtx)
+	rb.releaseBuildLock(storageCtx)
+}
+
+// nodeFinished updates the counters with a finished node, and sends the
+// required ready notification when needed
+func (rb *ResponseBuilder) nodeFinished(n *NodeBuilderResult) {
+	if n.nodeConf.Required {
+		rb.numReqPending -= 1
+	} else {
+		rb.numOptPending -= 1
 	}
+
+	if n.err != nil {
+		if !n.nodeConf.Required {
+			rb.numOptErr += 1
+			rb.applyFallback(n)
+			return
+		}
+		if !n.staleValid(time.Now()) {
+			rb.numReqErr += 1
+			if rb.numReqErr == 1 {
+				noBlockChanBoolRes(rb.requiredReady, false)
+			}
+			return
+		}
+		// the stale value is served, so we keep waiting for the
+		// other required nodes
+		rb.numReqStale += 1
+	}
+	if n.nodeConf.Required && rb.numReqPending == 0 && rb.numReqErr == 0 {
+		// we have all the required data
+		rb.markReady(true, false)
+		noBlockChanBoolRes(rb.requiredReady, true)
+	}
+}
+
+// applyFallback sets the fallback value of an optional node that has one
+// (see NodeConf.Fallback). The fallback function is called only once, the
+// concurrent calls wait for it.
+func (rb *ResponseBuilder) applyFallback(n *NodeBuilderResult) {
+	if !n.nodeConf.hasFallback() {
+		return
+	}
+	n.fallbackOnce.Do(func() {
+		fallback, err := n.nodeConf.fallback()
+		if err != nil {
+			// TODO: log the panic of the fallback function
+			return
+		}
+		rb.lock.Lock()
+		n.fallback, n.hasFallback = fallback, true
+		rb.lock.Unlock()
+	})
+}
+
+// stopWaiting applies the fallback values of the optional nodes that are
+// not built yet, once Build does not wait for them anymore
+func (rb *ResponseBuilder) stopWaiting() {
+	for idx := range rb.result {
+		n := &rb.result[idx]
+		rb.lock.RLock()
+		pending := !n.fetched
+		rb.lock.RUnlock()
+		if pending {
+			rb.applyFallback(n)
+		}
+	}
+}
+
+// markReady records the time the required nodes, or all the nodes,
+// are ready
+func (rb *ResponseBuilder) markReady(required bool, full bool) {
+	now := time.Now()
+	rb.lock.Lock()
+	if required {
+		rb.requiredReadyAt = now
+	}
+	if full {
+		rb.fullReadyAt = now
+	}
+	rb.lock.Unlock()
+}
+
+// launchDependents launches the build of the dependents of a finished node
+// that have all their dependencies built. If the node failed, its pending
+// dependents fail with a *DependencyError and are returned so they are
+// processed as finished nodes. Dependents that already finished (because
+// they were restored from the storage, or another dependency failed) are
+// left as they are.
+func (rb *ResponseBuilder) launchDependents(ctx context.Context, n *NodeBuilderResult,
+	readyChan chan<- *NodeBuilderResult) []*NodeBuilderResult {
+
+	var failed []*NodeBuilderResult
+	for _, idx := range n.dependents {
+		d := &rb.result[idx]
+		d.pendingDeps -= 1
+
+		rb.lock.Lock()
+		alreadyFinished := d.fetched
+		if n.err != nil && !alreadyFinished {
+			d.err = &DependencyError{
+				Key:        d.nodeConf.Key,
+				Dependency: n.nodeConf.Key,
+				Err:        n.err,
+			}
+			d.fetched = true
+			d.finishedAt = time.Now()
+		}
+		rb.lock.Unlock()
+
+		if alreadyFinished {
+			continue
+		}
+		if n.err != nil {
+			failed = append(failed, d)
+		} else if d.pendingDeps == 0 {
+			go rb.buildNode(ctx, d, readyChan)
+		}
+	}
+	return failed
 }
 
 // noBlockChanBoolRes sends a boolean result to a chan without blocking
@@ -251,47 +927,340 @@ func noBlockChanBoolRes(notifyChan chan<- bool, value bool) {
 	}
 }
 
+// nodeBuildResult holds what a node builder returned
+type nodeBuildResult struct {
+	res interface{}
+	err error
+}
+
+// nodeTimeout returns the timeout for a node, 0 if there is no timeout
+func (rb *ResponseBuilder) nodeTimeout(n *NodeConf) time.Duration {
+	if n.Timeout < 0 {
+		return 0
+	}
+	if n.Timeout > 0 {
+		return n.Timeout
+	}
+	return time.Millisecond * time.Duration(rb.buildNodeTimeoutMillis)
+}
+
+// runNodeBuilder runs the node builder with the node timeout. We do not
+// wait for bad behaved node builders that do not respect the context
+// cancellation: a *NodeTimeoutError is returned when the timeout expires,
+// and the node slot is held until the builder returns.
+// A panic in the node builder is returned as a *PanicError.
+func (rb *ResponseBuilder) runNodeBuilder(ctx context.Context,
+	node *NodeBuilderResult, slot *nodeSlot) (interface{}, error) {
+
+	timeout := rb.nodeTimeout(&node.nodeConf)
+	if timeout <= 0 {
+		return callNodeBuilder(ctx, node.nodeConf.Key, node.nodeConf.Builder,
+			rb.dataFetcher)
+	}
+
+	nodeCtx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	// buffered, so the builder goroutine can finish even if we are gone
+	resChan := make(chan nodeBuildResult, 1)
+	slot.hold()
+	go func() {
+		defer slot.release()
+		res, err := callNodeBuilder(nodeCtx, node.nodeConf.Key, node.nodeConf.Builder,
+			rb.dataFetcher)
+		resChan <- nodeBuildResult{res: res, err: err}
+	}()
+
+	select {
+	case r := <-resChan:
+		if r.err != nil && ctx.Err() == nil &&
+			errors.Is(nodeCtx.Err(), context.DeadlineExceeded) {
+			// most probably failed because of the timeout
+			return nil, &NodeTimeoutError{Key: node.nodeConf.Key, Timeout: timeout, Err: r.err}
+		}
+		return r.res, r.err
+	case <-nodeCtx.Done():
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		return nil, &NodeTimeoutError{Key: node.nodeConf.Key, Timeout: timeout}
+	}
+}
+
 // buildNode build
 func (rb *ResponseBuilder) buildNode(ctx context.Context, node *NodeBuilderResult,
 	readyChan chan<- *NodeBuilderResult) {
 
-	res, err := node.nodeConf.Builder(ctx, rb.dataFetcher)
+	if len(node.deps) > 0 {
+		rb.lock.RLock()
+		deps := make(map[string]interface{}, len(node.deps))
+		for _, idx := range node.deps {
+			deps[rb.result[idx].nodeConf.Key] = rb.result[idx].res
+		}
+		rb.lock.RUnlock()
+		ctx = withDependencyResults(ctx, deps)
+	}
+
+	// we wait for our turn, unless the build is cancelled
+	slot, err := acquireNodeSlot(ctx, rb.nodeSlots)
+	if err != nil {
+		rb.lock.Lock()
+		node.err = err
+		node.fetched = true
+		node.finishedAt = time.Now()
+		rb.lock.Unlock()
+		readyChan <- node
+		return
+	}
+	defer slot.release()
+
+	rb.lock.Lock()
+	node.startedAt = time.Now()
+	rb.lock.Unlock()
+
+	if rb.lockWait != nil && node.nodeConf.Static && rb.fromBuildLockHolder(ctx, node) {
+		readyChan <- node
+		return
+	}
+
+	var res interface{}
+	shared := false
+	if rb.coordinator != nil && node.nodeConf.Static {
+		res, shared, err = rb.coordinator.do(ctx, rb.storageKey, node.nodeConf.Key,
+			rb.nodeTimeout(&node.nodeConf), func(ctx context.Context) (interface{}, error) {
+				return rb.runNodeBuilder(ctx, node, slot)
+			})
+	} else {
+		res, err = rb.runNodeBuilder(ctx, node, slot)
+	}
 
 	rb.lock.Lock()
 	node.err = err
 	node.res = res
 	node.fetched = true
+	node.builtAt = time.Now()
+	node.finishedAt = node.builtAt
+	if shared {
+		node.source = SourceShared
+	} else {
+		node.source = SourceBuilt
+		node.attempts += 1
+	}
 	rb.lock.Unlock()
 
 	readyChan <- node
 }
 
-func (rb *ResponseBuilder) fromStorage(ctx context.Context) {
-	// TODO: we might want to use []bytes in the storage interface
-	// instead of string
-	res, err := rb.storage.Get(ctx, rb.storageKey)
+// acquireBuildLock tries to get the build lock when there are static
+// nodes to build (see BuildLockConf). If another builder holds it, the
+// static nodes wait for it to save them.
+func (rb *ResponseBuilder) acquireBuildLock(ctx context.Context) {
+	lockStorage, ok := rb.storage.(LockKeyValStorage)
+	if !ok || rb.buildLock.TTL <= 0 || !supportsLocks(rb.storage) {
+		return
+	}
+	var missing []string
+	for idx := range rb.result {
+		if rb.result[idx].nodeConf.Static && !rb.result[idx].fetched {
+			missing = append(missing, rb.result[idx].nodeConf.Key)
+		}
+	}
+	if len(missing) == 0 {
+		return
+	}
+
+	token := newLockToken()
+	acquired, err := lockStorage.SetNX(ctx, rb.lockKey(), token, rb.buildLock.TTL)
 	if err != nil {
-		// TODO: log the error
+		// TODO: log the error, we build the nodes as if there was no lock
+		return
+	}
+	if acquired {
+		rb.lockToken = token
 		return
 	}
+	rb.lockWait = make(chan struct{})
+	go rb.waitForBuildLock(ctx, missing)
+}
+
+// waitForBuildLock polls the storage until the missing static nodes are
+// saved by the lock holder, or the lock wait time expires, and keeps the
+// stored nodes in lockStored.
+func (rb *ResponseBuilder) waitForBuildLock(ctx context.Context, missing []string) {
+	defer close(rb.lockWait)
+
+	deadline := time.Now().Add(rb.buildLock.Wait)
+	for {
+		stored, _ := rb.storedNodes(ctx)
+		complete := true
+		for _, key := range missing {
+			if _, ok := stored[key]; !ok {
+				complete = false
+				break
+			}
+		}
+		if complete || !time.Now().Before(deadline) {
+			rb.lockStored = stored
+			return
+		}
+
+		timer := time.NewTimer(rb.buildLock.PollInterval)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		}
+	}
+}
+
+// fromBuildLockHolder waits for the static nodes saved by the lock holder,
+// and sets the node result if it is one of them, or if it is an optional
+// node that we will not build. It returns false when we have to build the
+// node.
+func (rb *ResponseBuilder) fromBuildLockHolder(ctx context.Context,
+	node *NodeBuilderResult) bool {
+
+	select {
+	case <-rb.lockWait:
+	case <-ctx.Done():
+	}
+
+	var val interface{}
+	var builtAt time.Time
+	err := ctx.Err()
+	if err == nil {
+		// lockStored is only set once lockWait is closed
+		sn, ok := rb.lockStored[node.nodeConf.Key]
+		if ok {
+			val, err = rb.decodeStoredNode(&node.nodeConf, sn)
+			builtAt = sn.builtAt
+		}
+		if !ok || err != nil {
+			if node.nodeConf.Required {
+				return false
+			}
+			err = ErrBuildLocked
+		}
+	}
+
+	rb.lock.Lock()
+	node.res = val
+	node.err = err
+	node.fetched = true
+	node.builtAt = builtAt
+	node.finishedAt = time.Now()
+	if err == nil {
+		node.source = SourceStorage
+	}
+	rb.lock.Unlock()
+	return true
+}
+
+// releaseBuildLock releases the build lock if we hold it. If it fails,
+// the lock will expire after its TTL.
+func (rb *ResponseBuilder) releaseBuildLock(ctx context.Context) {
+	if rb.lockToken == nil {
+		return
+	}
+	lockStorage := rb.storage.(LockKeyValStorage)
+	if _, err := lockStorage.DelIfEqual(ctx, rb.lockKey(), rb.lockToken); err != nil {
+		// TODO: log the error
+	}
+	rb.lockToken = nil
+}
+
+// detachedContext keeps the values of its parent context, but not its
+// deadline nor its cancellation
+type detachedContext struct {
+	parent context.Context
+}
+
+func (c detachedContext) Deadline() (time.Time, bool) { return time.Time{}, false }
+func (c detachedContext) Done() <-chan struct{}       { return nil }
+func (c detachedContext) Err() error                  { return nil }
+
+func (c detachedContext) Value(key interface{}) interface{} {
+	return c.parent.Value(key)
+}
+
+// lockKey is the storage key for the build lock
+func (rb *ResponseBuilder) lockKey() string {
+	return rb.storageKey + ".lock"
+}
+
+// newLockToken returns a random value to identify the lock holder
+func newLockToken() []byte {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		// very unlikely, the time is good enough to tell holders apart
+		return []byte(time.Now().Format(time.RFC3339Nano))
+	}
+	return []byte(fmt.Sprintf("%x", b))
+}
+
+// storedNodes reads the nodes saved in the storage
+func (rb *ResponseBuilder) storedNodes(ctx context.Context) (map[string]storedNode, error) {
+	res, err := rb.storage.Get(ctx, rb.storageKey)
+	if err != nil {
+		return nil, err
+	}
 
 	if len(res) == 0 {
 		// NO data found in storage
-		return
+		return nil, nil
 	}
+	return decodeStoredNodes(res)
+}
 
-	resp := map[string]interface{}{}
-	err = json.Unmarshal(res, &resp)
+// decodeStoredNode decodes the result of a node saved in the storage
+func (rb *ResponseBuilder) decodeStoredNode(n *NodeConf, sn storedNode) (interface{}, error) {
+	codec := rb.nodeCodec(n)
+	if sn.codec != codec.Name() {
+		return nil, fmt.Errorf("node %s saved with codec %s", n.Key, sn.codec)
+	}
+	return decodeNodeResult(codec, sn.data, n.NewResult)
+}
+
+func (rb *ResponseBuilder) fromStorage(ctx context.Context) {
+	stored, err := rb.storedNodes(ctx)
 	if err != nil {
 		// Bad data in Storage !? can that really happen ?
 		// TODO: log the error
 		return
 	}
 
-	for _, r := range rb.result {
-		if val, ok := resp[r.nodeConf.Key]; ok {
+	rb.lock.Lock()
+	defer rb.lock.Unlock()
+	now := time.Now()
+	for idx := range rb.result {
+		r := &rb.result[idx]
+		if sn, ok := stored[r.nodeConf.Key]; ok && !sn.expired(now) {
+			// when saved with another codec we will build it again
+			val, err := rb.decodeStoredNode(&r.nodeConf, sn)
+			if err != nil {
+				// TODO: log the error
+				continue
+			}
+			if r.nodeConf.StaleAllowed {
+				// dynamic nodes are always built, but we keep the
+				// previous value in case the fresh one is not ready
+				r.stale = val
+				r.staleBuiltAt = sn.builtAt
+				r.staleExpiresAt = sn.expiresAt
+				r.hasStale = true
+				continue
+			}
+			if !r.nodeConf.Static {
+				continue
+			}
 			r.res = val
 			r.fetched = true
+			r.builtAt = sn.builtAt
+			r.expiresAt = sn.expiresAt
+			r.source = SourceStorage
+			r.startedAt = now
+			r.finishedAt = now
 			if r.nodeConf.Required {
 				rb.numReqPending -= 1
 			} else {
@@ -301,26 +1270,88 @@ func (rb *ResponseBuilder) fromStorage(ctx context.Context) {
 	}
 }
 
+// toStorage saves the static nodes, and the dynamic nodes that allow
+// stale values (keeping the previous value if the fresh one failed, the
+// fallback values are never saved).
+// Nothing is saved if none of them was built by this builder, as the
+// stored value would not change (or it is saved by the builder we shared
+// the nodes with), or if another builder holds the build lock.
 func (rb *ResponseBuilder) toStorage(ctx context.Context) {
-	staticNodes := make(map[string]interface{}, len(rb.result))
+	if rb.lockWait != nil {
+		return
+	}
+	storedNodes := make([]storedNode, 0, len(rb.result))
+	numBuilt := 0
 
 	rb.lock.RLock()
-	for _, n := range rb.result {
-		if n.nodeConf.Static && n.fetched {
-			staticNodes[n.nodeConf.Key] = n.res
+	for idx := range rb.result {
+		n := &rb.result[idx]
+		if !n.nodeConf.Static && !n.nodeConf.StaleAllowed {
+			continue
+		}
+
+		// the restored nodes keep their expiration, so rewriting them
+		// does not keep them forever
+		val, builtAt, expiresAt := n.res, n.builtAt, rb.expiresAt(n.builtAt)
+		if n.source == SourceStorage && !n.expiresAt.IsZero() {
+			expiresAt = n.expiresAt
+		}
+		if n.fetched && n.err == nil && n.source == SourceBuilt {
+			numBuilt += 1
+		}
+		if !n.fetched || n.err != nil {
+			if !n.hasStale {
+				continue
+			}
+			val, builtAt, expiresAt = n.stale, n.staleBuiltAt, n.staleExpiresAt
+			if expiresAt.IsZero() {
+				expiresAt = rb.expiresAt(builtAt)
+			}
+		}
+
+		codec := rb.nodeCodec(&n.nodeConf)
+		data, err := codec.Marshal(val)
+		if err != nil {
+			// TODO: log and continue
+			continue
 		}
+		storedNodes = append(storedNodes, storedNode{
+			key:       n.nodeConf.Key,
+			codec:     codec.Name(),
+			builtAt:   builtAt,
+			expiresAt: expiresAt,
+			data:      data,
+		})
 	}
 	rb.lock.RUnlock()
 
-	b, err := json.Marshal(staticNodes)
-	if err != nil {
-		// TODO: log and continue
+	if numBuilt == 0 {
 		return
 	}
-
-	err = rb.storage.Set(ctx, rb.storageKey, b)
+	b := encodeStoredNodes(storedNodes)
+	err := setWithTTL(ctx, rb.storage, rb.storageKey, b, rb.storageTTL)
 	if err != nil {
 		// TODO: log and continue,
 		return
 	}
 }
+
+// expiresAt returns when a node built at builtAt (now if it is unknown)
+// expires in the storage, zero if there is no storage TTL
+func (rb *ResponseBuilder) expiresAt(builtAt time.Time) time.Time {
+	if rb.storageTTL <= 0 {
+		return time.Time{}
+	}
+	if builtAt.IsZero() {
+		builtAt = time.Now()
+	}
+	return builtAt.Add(rb.storageTTL)
+}
+
+// nodeCodec returns the codec to save and restore a node
+func (rb *ResponseBuilder) nodeCodec(n *NodeConf) Codec {
+	if n.Codec != nil {
+		return n.Codec
+	}
+	return rb.codec
+}
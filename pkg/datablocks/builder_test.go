@@ -2,7 +2,10 @@ package datablocks
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"strings"
+	"sync/atomic"
 	"testing"
 	"time"
 )
@@ -37,12 +40,16 @@ func Test_BuilderWithNoNodes(t *testing.T) {
 	// no NodeBuilder will try to fetch twice the same data
 	dataFetcher := NewDataFetcherImpl(len(nodesConf))
 
-	rb := NewResponseBuilder(storageKey, storage, dataFetcher, nodesConf, 800)
+	rb, err := NewResponseBuilder(storageKey, storage, dataFetcher, nodesConf, 800)
+	if err != nil {
+		t.Errorf("unexpected error %s", err.Error())
+		return
+	}
 
 	reqReady := make(chan bool, 1)
 	fullReady := make(chan bool, 1)
 
-	rb.Build(context.Background(), reqReady, fullReady)
+	rb.BuildAsync(context.Background(), reqReady, fullReady)
 
 	timeout := time.After(time.Second)
 	select {
@@ -79,11 +86,15 @@ func Test_BuilderWithSingleStaticNode(t *testing.T) {
 
 	storage := NewNopKeyValStorage()
 	dataFetcher := NewDataFetcherImpl(len(nodesConf))
-	rb := NewResponseBuilder("test_response", storage, dataFetcher, nodesConf, 800)
+	rb, err := NewResponseBuilder("test_response", storage, dataFetcher, nodesConf, 800)
+	if err != nil {
+		t.Errorf("unexpected error %s", err.Error())
+		return
+	}
 	reqReady := make(chan bool, 1)
 	fullReady := make(chan bool, 1)
 
-	rb.Build(context.Background(), reqReady, fullReady)
+	rb.BuildAsync(context.Background(), reqReady, fullReady)
 
 	timeout := time.After(time.Millisecond * time.Duration(1000))
 	select {
@@ -149,11 +160,15 @@ func Test_BuilderWithSeveralStaticNodesOneTimingOut(t *testing.T) {
 
 	storage := NewNopKeyValStorage()
 	dataFetcher := NewDataFetcherImpl(len(nodesConf))
-	rb := NewResponseBuilder("test_response", storage, dataFetcher, nodesConf, 50)
+	rb, err := NewResponseBuilder("test_response", storage, dataFetcher, nodesConf, 50)
+	if err != nil {
+		t.Errorf("unexpected error %s", err.Error())
+		return
+	}
 	reqReady := make(chan bool, 1)
 	fullReady := make(chan bool, 1)
 
-	rb.Build(context.Background(), reqReady, fullReady)
+	rb.BuildAsync(context.Background(), reqReady, fullReady)
 
 	timeout := time.After(time.Millisecond * time.Duration(1000))
 	select {
@@ -197,5 +212,1095 @@ func Test_BuilderWithSeveralStaticNodesOneTimingOut(t *testing.T) {
 		t.Errorf("node n2 should be missing")
 		return
 	}
-	t.Errorf("fail")
+}
+
+// ttlRecorderStorage records the ttl used to save the results
+type ttlRecorderStorage struct {
+	*InMemStorage
+	ttls chan time.Duration
+}
+
+func (s *ttlRecorderStorage) SetWithTTL(ctx context.Context, key string,
+	val []byte, ttl time.Duration) error {
+	s.ttls <- ttl
+	return s.InMemStorage.SetWithTTL(ctx, key, val, ttl)
+}
+
+func Test_BuilderStorageTTL(t *testing.T) {
+	nodesConf := []NodeConf{
+		NodeConf{
+			Key:      "foo",
+			Static:   true,
+			Required: true,
+			Builder:  newTestDelayedNodeBuilder(1, nil),
+		},
+	}
+
+	storage := &ttlRecorderStorage{
+		InMemStorage: NewInMemKeyValStorage(),
+		ttls:         make(chan time.Duration, 1),
+	}
+	dataFetcher := NewDataFetcherImpl(len(nodesConf))
+	rb, err := NewResponseBuilder("test_response", storage, dataFetcher, nodesConf, 800)
+	if err != nil {
+		t.Errorf("unexpected error %s", err.Error())
+		return
+	}
+	rb.SetStorageTTL(time.Minute)
+	rb.BuildAsync(context.Background(), nil, nil)
+
+	select {
+	case ttl := <-storage.ttls:
+		if ttl != time.Minute {
+			t.Errorf("ttl, want 1m, got %v", ttl)
+		}
+	case <-time.After(time.Second):
+		t.Errorf("time expired waiting for the result to be stored")
+	}
+}
+
+func Test_BuilderBuildWithConfig(t *testing.T) {
+	rb, err := NewResponseBuilderWithConfig(NewNopKeyValStorage(), BuilderConfig{
+		StorageKey: "test_response",
+		Nodes: []NodeConf{
+			NodeConf{
+				Key:      "req",
+				Required: true,
+				Builder:  newTestDelayedNodeBuilder(5, nil),
+			},
+			NodeConf{
+				Key:     "fast_opt",
+				Builder: newTestDelayedNodeBuilder(15, nil),
+			},
+			NodeConf{
+				Key:     "slow_opt",
+				Builder: newTestDelayedNodeBuilder(500, nil),
+			},
+		},
+		NodeTimeout:      time.Second,
+		RequiredDeadline: 100 * time.Millisecond,
+		GracePeriod:      50 * time.Millisecond,
+	})
+	if err != nil {
+		t.Errorf("unexpected error %s", err.Error())
+		return
+	}
+
+	res, err := rb.Build(context.Background())
+	if err != nil {
+		t.Errorf("unexpected error %s", err.Error())
+		return
+	}
+	if _, ok := res["req"]; !ok {
+		t.Errorf("missing required node")
+	}
+	if _, ok := res["fast_opt"]; !ok {
+		t.Errorf("missing optional node built during the grace period")
+	}
+	if _, ok := res["slow_opt"]; ok {
+		t.Errorf("slow optional node should not be ready")
+	}
+
+	if _, err := rb.Build(context.Background()); err != ErrBuildStarted {
+		t.Errorf("want ErrBuildStarted, got %v", err)
+	}
+}
+
+func Test_BuilderBuildRequiredErrors(t *testing.T) {
+	buildErr := fmt.Errorf("failed")
+	rb, err := NewResponseBuilderWithConfig(NewNopKeyValStorage(), BuilderConfig{
+		StorageKey: "test_response",
+		Nodes: []NodeConf{
+			NodeConf{
+				Key:      "failing",
+				Required: true,
+				Builder:  newTestDelayedNodeBuilder(1, buildErr),
+			},
+			NodeConf{
+				Key:      "slow",
+				Required: true,
+				Builder:  newTestDelayedNodeBuilder(500, nil),
+			},
+		},
+		RequiredDeadline: 100 * time.Millisecond,
+	})
+	if err != nil {
+		t.Errorf("unexpected error %s", err.Error())
+		return
+	}
+
+	start := time.Now()
+	_, err = rb.Build(context.Background())
+	if time.Since(start) > 50*time.Millisecond {
+		t.Errorf("Build should return as soon as a required node fails")
+	}
+
+	var reqErr *RequiredNodesError
+	if !errors.As(err, &reqErr) {
+		t.Errorf("want a RequiredNodesError, got %v", err)
+		return
+	}
+	if reqErr.Errs["failing"] != buildErr {
+		t.Errorf("failing node, want %v, got %v", buildErr, reqErr.Errs["failing"])
+	}
+	if reqErr.Errs["slow"] != ErrNodeNotReady {
+		t.Errorf("slow node, want ErrNodeNotReady, got %v", reqErr.Errs["slow"])
+	}
+
+	// the required deadline
+	rb, err = NewResponseBuilderWithConfig(NewNopKeyValStorage(), BuilderConfig{
+		StorageKey: "test_response",
+		Nodes: []NodeConf{
+			NodeConf{
+				Key:      "slow",
+				Required: true,
+				Builder:  newTestDelayedNodeBuilder(500, nil),
+			},
+		},
+		RequiredDeadline: 20 * time.Millisecond,
+	})
+	if err != nil {
+		t.Errorf("unexpected error %s", err.Error())
+		return
+	}
+	_, err = rb.Build(context.Background())
+	if !errors.As(err, &reqErr) || reqErr.Errs["slow"] != ErrNodeNotReady {
+		t.Errorf("want a RequiredNodesError with a node not ready, got %v", err)
+	}
+}
+
+func Test_BuilderNodeDependencies(t *testing.T) {
+	depErr := fmt.Errorf("failed")
+	nodesConf := []NodeConf{
+		NodeConf{
+			Key:      "order",
+			Required: true,
+			Builder: func(ctx context.Context, df DataFetcher) (interface{}, error) {
+				time.Sleep(5 * time.Millisecond)
+				return []string{"p1", "p2"}, nil
+			},
+		},
+		NodeConf{
+			Key:       "products",
+			Required:  true,
+			DependsOn: []string{"order"},
+			Builder: func(ctx context.Context, df DataFetcher) (interface{}, error) {
+				order, err := Dependency[[]string](ctx, "order")
+				if err != nil {
+					return nil, err
+				}
+				return len(order), nil
+			},
+		},
+		NodeConf{
+			Key:     "failing",
+			Builder: newTestDelayedNodeBuilder(1, depErr),
+		},
+		NodeConf{
+			Key:       "child",
+			DependsOn: []string{"failing", "order"},
+			Builder:   newTestDelayedNodeBuilder(1, nil),
+		},
+		NodeConf{
+			Key:       "grandchild",
+			DependsOn: []string{"child"},
+			Builder:   newTestDelayedNodeBuilder(1, nil),
+		},
+	}
+
+	rb, err := NewResponseBuilderWithConfig(NewNopKeyValStorage(), BuilderConfig{
+		StorageKey:  "test_response",
+		Nodes:       nodesConf,
+		GracePeriod: 100 * time.Millisecond,
+	})
+	if err != nil {
+		t.Errorf("unexpected error %s", err.Error())
+		return
+	}
+
+	res, err := rb.Build(context.Background())
+	if err != nil {
+		t.Errorf("unexpected error %s", err.Error())
+		return
+	}
+	if res["products"] != 2 {
+		t.Errorf("products, want 2, got %v", res["products"])
+	}
+	if len(res) != 2 {
+		t.Errorf("output len, want 2, got %d", len(res))
+	}
+
+	rb.lock.RLock()
+	defer rb.lock.RUnlock()
+	for _, idx := range []int{3, 4} {
+		var depErr *DependencyError
+		if !errors.As(rb.result[idx].err, &depErr) {
+			t.Errorf("%s, want a DependencyError, got %v", rb.result[idx].nodeConf.Key,
+				rb.result[idx].err)
+		}
+	}
+}
+
+func Test_BuilderDependencyErrors(t *testing.T) {
+	builder := newTestDelayedNodeBuilder(1, nil)
+	_, err := NewResponseBuilder("test_response", NewNopKeyValStorage(),
+		NewDataFetcherImpl(2), []NodeConf{
+			NodeConf{Key: "a", Builder: builder, DependsOn: []string{"missing"}},
+		}, 800)
+	if err == nil {
+		t.Errorf("want an error for an unknown dependency")
+	}
+
+	_, err = NewResponseBuilder("test_response", NewNopKeyValStorage(),
+		NewDataFetcherImpl(2), []NodeConf{
+			NodeConf{Key: "a", Builder: builder, DependsOn: []string{"b"}},
+			NodeConf{Key: "b", Builder: builder, DependsOn: []string{"c"}},
+			NodeConf{Key: "c", Builder: builder, DependsOn: []string{"a"}},
+			NodeConf{Key: "d", Builder: builder, DependsOn: []string{"a"}},
+		}, 800)
+	var cycleErr *DependencyCycleError
+	if !errors.As(err, &cycleErr) {
+		t.Errorf("want a DependencyCycleError, got %v", err)
+		return
+	}
+	if strings.Join(cycleErr.Cycle, ",") != "a,b,c" {
+		t.Errorf("cycle, want a,b,c, got %v", cycleErr.Cycle)
+	}
+}
+
+func Test_BuilderPerNodeTimeouts(t *testing.T) {
+	// this builder does not respect the context cancellation
+	stuck := func(ctx context.Context, df DataFetcher) (interface{}, error) {
+		time.Sleep(200 * time.Millisecond)
+		return "late", nil
+	}
+	nodesConf := []NodeConf{
+		NodeConf{
+			Key:      "slow_allowed",
+			Required: true,
+			Timeout:  100 * time.Millisecond,
+			Builder:  newTestDelayedNodeBuilder(40, nil),
+		},
+		NodeConf{
+			Key:      "fast_budget",
+			Required: false,
+			Timeout:  5 * time.Millisecond,
+			Builder:  newTestDelayedNodeBuilder(40, nil),
+		},
+		NodeConf{
+			Key:      "stuck",
+			Required: false,
+			Builder:  stuck,
+		},
+		NodeConf{
+			Key:      "failing",
+			Required: false,
+			Builder:  newTestDelayedNodeBuilder(1, fmt.Errorf("failed")),
+		},
+	}
+
+	rb, err := NewResponseBuilder("test_response", NewNopKeyValStorage(),
+		NewDataFetcherImpl(len(nodesConf)), nodesConf, 20)
+	if err != nil {
+		t.Errorf("unexpected error %s", err.Error())
+		return
+	}
+	fullReady := make(chan bool, 1)
+	start := time.Now()
+	rb.BuildAsync(context.Background(), nil, fullReady)
+
+	select {
+	case <-fullReady:
+	case <-time.After(time.Second):
+		t.Errorf("time expired")
+		return
+	}
+	if time.Since(start) > 150*time.Millisecond {
+		t.Errorf("should not wait for the stuck node builder")
+	}
+
+	output := rb.Result()
+	if _, ok := output["slow_allowed"]; !ok {
+		t.Errorf("node with a longer timeout should be built")
+	}
+
+	rb.lock.RLock()
+	defer rb.lock.RUnlock()
+	for idx, wantTimeout := range []bool{false, true, true, false} {
+		var timeoutErr *NodeTimeoutError
+		isTimeout := errors.As(rb.result[idx].err, &timeoutErr)
+		if isTimeout != wantTimeout {
+			t.Errorf("%s, want timeout %v, got error %v", rb.result[idx].nodeConf.Key,
+				wantTimeout, rb.result[idx].err)
+		}
+	}
+	if !errors.Is(rb.result[2].err, context.DeadlineExceeded) {
+		t.Errorf("timeout error should match context.DeadlineExceeded")
+	}
+}
+
+// newTestValueNodeBuilder returns val after millis milliseconds
+func newTestValueNodeBuilder(millis int, val interface{}) NodeBuilderFn {
+	return func(ctx context.Context, df DataFetcher) (interface{}, error) {
+		select {
+		case <-time.After(time.Duration(millis) * time.Millisecond):
+			return val, nil
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+func Test_BuilderStaleDynamicNodes(t *testing.T) {
+	storage := NewInMemKeyValStorage()
+	newConf := func(millis int, val string, maxStaleness time.Duration) BuilderConfig {
+		return BuilderConfig{
+			StorageKey: "test_response",
+			Nodes: []NodeConf{
+				NodeConf{
+					Key:          "dyn",
+					Required:     true,
+					StaleAllowed: true,
+					MaxStaleness: maxStaleness,
+					Builder:      newTestValueNodeBuilder(millis, val),
+				},
+			},
+			RequiredDeadline: 20 * time.Millisecond,
+		}
+	}
+
+	// first run, nothing stored yet
+	rb, err := NewResponseBuilderWithConfig(storage, newConf(1, "v1", 0))
+	if err != nil {
+		t.Errorf("unexpected error %s", err.Error())
+		return
+	}
+	fullReady := make(chan bool, 1)
+	rb.BuildAsync(context.Background(), nil, fullReady)
+	<-fullReady
+
+	// second run, the fresh value is not ready in time
+	rb, _ = NewResponseBuilderWithConfig(storage, newConf(50, "v2", 0))
+	res, err := rb.Build(context.Background())
+	if err != nil {
+		t.Errorf("unexpected error %s", err.Error())
+		return
+	}
+	if res["dyn"] != "v1" {
+		t.Errorf("want the stale value v1, got %v", res["dyn"])
+		return
+	}
+
+	// the fresh value is written back once built
+	time.Sleep(60 * time.Millisecond)
+	if res := rb.Result(); res["dyn"] != "v2" {
+		t.Errorf("want the fresh value v2, got %v", res["dyn"])
+		return
+	}
+	rb, _ = NewResponseBuilderWithConfig(storage, newConf(50, "v3", 0))
+	res, _ = rb.Build(context.Background())
+	if res["dyn"] != "v2" {
+		t.Errorf("want the stale value v2, got %v", res["dyn"])
+		return
+	}
+
+	// too old values are not served
+	time.Sleep(60 * time.Millisecond)
+	rb, _ = NewResponseBuilderWithConfig(storage, newConf(50, "v4", 10*time.Millisecond))
+	_, err = rb.Build(context.Background())
+	var reqErr *RequiredNodesError
+	if !errors.As(err, &reqErr) {
+		t.Errorf("want a RequiredNodesError, got %v", err)
+	}
+}
+
+func Test_BuilderStaleRequiredNodeKeepsWaiting(t *testing.T) {
+	storage := NewInMemKeyValStorage()
+	newConf := func(dyn NodeBuilderFn) BuilderConfig {
+		return BuilderConfig{
+			StorageKey: "test_response",
+			Nodes: []NodeConf{
+				NodeConf{
+					Key:          "dyn",
+					Required:     true,
+					StaleAllowed: true,
+					Builder:      dyn,
+				},
+				NodeConf{
+					Key:      "slow",
+					Required: true,
+					Builder:  newTestValueNodeBuilder(50, "s"),
+				},
+			},
+		}
+	}
+
+	rb, err := NewResponseBuilderWithConfig(storage, newConf(newTestValueNodeBuilder(1, "v1")))
+	if err != nil {
+		t.Errorf("unexpected error %s", err.Error())
+		return
+	}
+	if !buildAndWait(t, rb) {
+		t.Errorf("first build failed")
+		return
+	}
+
+	// the failed node is served stale, and we still wait for the slow one
+	rb, _ = NewResponseBuilderWithConfig(storage,
+		newConf(newTestDelayedNodeBuilder(1, fmt.Errorf("build failed"))))
+	res, err := rb.Build(context.Background())
+	if err != nil {
+		t.Errorf("unexpected error %s", err.Error())
+		return
+	}
+	if res["dyn"] != "v1" || res["slow"] != "s" {
+		t.Errorf("unexpected result %v", res)
+	}
+}
+
+// countingNodeBuilder counts the calls to a node builder, that returns
+// val, or fails while failures is greater than the number of calls
+type countingNodeBuilder struct {
+	calls    int32
+	failures int32
+	val      interface{}
+}
+
+func (c *countingNodeBuilder) Build(ctx context.Context, df DataFetcher) (interface{}, error) {
+	if atomic.AddInt32(&c.calls, 1) <= c.failures {
+		return nil, fmt.Errorf("failed")
+	}
+	return c.val, nil
+}
+
+func (c *countingNodeBuilder) Calls() int {
+	return int(atomic.LoadInt32(&c.calls))
+}
+
+// buildAndWait builds the response, and waits for it to be fully built
+func buildAndWait(t *testing.T, rb *ResponseBuilder) bool {
+	fullReady := make(chan bool, 1)
+	rb.BuildAsync(context.Background(), nil, fullReady)
+	select {
+	case res := <-fullReady:
+		return res
+	case <-time.After(time.Second):
+		t.Errorf("time expired")
+		return false
+	}
+}
+
+func Test_BuilderRestoresCachedNodes(t *testing.T) {
+	storage := NewInMemKeyValStorage()
+	builders := map[string]*countingNodeBuilder{
+		"a": &countingNodeBuilder{val: "a"},
+		"b": &countingNodeBuilder{val: "b"},
+		"c": &countingNodeBuilder{val: "c"},
+		// d fails the first time, so it is not cached
+		"d": &countingNodeBuilder{val: "d", failures: 1},
+	}
+	nodesConf := []NodeConf{
+		NodeConf{Key: "a", Static: true, Required: true, Builder: builders["a"].Build},
+		NodeConf{Key: "b", Static: true, Required: false, Builder: builders["b"].Build},
+		NodeConf{Key: "c", Static: false, Required: true, Builder: builders["c"].Build},
+		NodeConf{Key: "d", Static: true, Required: false, Builder: builders["d"].Build},
+	}
+
+	rb, _ := NewResponseBuilder("test_response", storage, NewDataFetcherImpl(4),
+		nodesConf, 100)
+	if buildAndWait(t, rb) {
+		t.Errorf("first build, want a failed optional node")
+		return
+	}
+
+	rb, _ = NewResponseBuilder("test_response", storage, NewDataFetcherImpl(4),
+		nodesConf, 100)
+	if !buildAndWait(t, rb) {
+		t.Errorf("second build, want all the nodes built")
+		return
+	}
+
+	wantCalls := map[string]int{"a": 1, "b": 1, "c": 2, "d": 2}
+	for k, want := range wantCalls {
+		if calls := builders[k].Calls(); calls != want {
+			t.Errorf("%s builder calls, want %d, got %d", k, want, calls)
+		}
+	}
+
+	output := rb.Result()
+	for _, k := range []string{"a", "b", "c", "d"} {
+		if output[k] != k {
+			t.Errorf("%s, want %q, got %#v", k, k, output[k])
+		}
+	}
+
+	report := rb.Report()
+	wantSources := map[string]NodeSource{
+		"a": SourceStorage,
+		"b": SourceStorage,
+		"c": SourceBuilt,
+		"d": SourceBuilt,
+	}
+	for k, want := range wantSources {
+		if n, _ := report.Node(k); n.Source != want {
+			t.Errorf("%s source, want %s, got %s", k, want, n.Source)
+		}
+	}
+}
+
+func Test_BuilderAllNodesCached(t *testing.T) {
+	storage := NewInMemKeyValStorage()
+	a := &countingNodeBuilder{val: "a"}
+	b := &countingNodeBuilder{val: "b"}
+	nodesConf := []NodeConf{
+		NodeConf{Key: "a", Static: true, Required: true, Builder: a.Build},
+		NodeConf{Key: "b", Static: true, Required: false, Builder: b.Build},
+	}
+
+	for i := 0; i < 3; i++ {
+		rb, _ := NewResponseBuilder("test_response", storage, NewDataFetcherImpl(2),
+			nodesConf, 100)
+		reqReady := make(chan bool, 1)
+		fullReady := make(chan bool, 1)
+		rb.BuildAsync(context.Background(), reqReady, fullReady)
+		if !<-reqReady || !<-fullReady {
+			t.Errorf("run %d, want the response ready", i)
+			return
+		}
+		if output := rb.Result(); len(output) != 2 {
+			t.Errorf("run %d, output len, want 2, got %d", i, len(output))
+			return
+		}
+
+		rb.lock.RLock()
+		pending := rb.numReqPending + rb.numOptPending
+		rb.lock.RUnlock()
+		if pending != 0 {
+			t.Errorf("run %d, pending nodes, want 0, got %d", i, pending)
+			return
+		}
+	}
+
+	if a.Calls() != 1 || b.Calls() != 1 {
+		t.Errorf("cached nodes should be built once, got %d and %d",
+			a.Calls(), b.Calls())
+	}
+}
+
+func Test_BuilderDependsOnRestoredNode(t *testing.T) {
+	storage := NewInMemKeyValStorage()
+	order := &countingNodeBuilder{val: "order_1"}
+	products := func(ctx context.Context, df DataFetcher) (interface{}, error) {
+		o, ok := DependencyResult(ctx, "order")
+		if !ok {
+			return nil, fmt.Errorf("missing order")
+		}
+		return fmt.Sprintf("products_of_%v", o), nil
+	}
+	nodesConf := []NodeConf{
+		NodeConf{Key: "order", Static: true, Required: true, Builder: order.Build},
+		NodeConf{
+			Key:       "products",
+			Static:    false,
+			Required:  true,
+			DependsOn: []string{"order"},
+			Builder:   products,
+		},
+	}
+
+	for i := 0; i < 2; i++ {
+		rb, _ := NewResponseBuilder("test_response", storage, NewDataFetcherImpl(2),
+			nodesConf, 100)
+		if !buildAndWait(t, rb) {
+			t.Errorf("run %d, want all the nodes built", i)
+			return
+		}
+		if output := rb.Result(); output["products"] != "products_of_order_1" {
+			t.Errorf("run %d, unexpected products %#v", i, output["products"])
+			return
+		}
+	}
+	if order.Calls() != 1 {
+		t.Errorf("order builder calls, want 1, got %d", order.Calls())
+	}
+}
+
+// countingLockStorage is a countingStorage that can hold locks
+type countingLockStorage struct {
+	*countingStorage
+	locks *InMemStorage
+}
+
+func newCountingLockStorage() *countingLockStorage {
+	s := NewInMemKeyValStorage()
+	return &countingLockStorage{countingStorage: newCountingStorage(s), locks: s}
+}
+
+func (s *countingLockStorage) SetNX(ctx context.Context, key string, val []byte,
+	ttl time.Duration) (bool, error) {
+	return s.locks.SetNX(ctx, key, val, ttl)
+}
+
+func (s *countingLockStorage) DelIfEqual(ctx context.Context, key string,
+	val []byte) (bool, error) {
+	return s.locks.DelIfEqual(ctx, key, val)
+}
+
+func Test_BuilderBuildLock(t *testing.T) {
+	for _, tc := range []struct {
+		name       string
+		wait       time.Duration
+		wantACalls int
+		wantBErr   error
+	}{
+		// the second builder gets the nodes saved by the lock holder
+		{name: "wait", wait: 200 * time.Millisecond, wantACalls: 1},
+		// the second builder builds the required nodes only
+		{name: "no_wait", wait: 5 * time.Millisecond, wantACalls: 2, wantBErr: ErrBuildLocked},
+	} {
+		storage := newCountingLockStorage()
+		a := &countingNodeBuilder{val: "a"}
+		b := &countingNodeBuilder{val: "b"}
+		c := &countingNodeBuilder{val: "c"}
+		slow := func(builder *countingNodeBuilder) NodeBuilderFn {
+			return func(ctx context.Context, df DataFetcher) (interface{}, error) {
+				time.Sleep(30 * time.Millisecond)
+				return builder.Build(ctx, df)
+			}
+		}
+		conf := BuilderConfig{
+			StorageKey: "test_response",
+			Nodes: []NodeConf{
+				NodeConf{Key: "a", Static: true, Required: true, Builder: slow(a)},
+				NodeConf{Key: "b", Static: true, Required: false, Builder: slow(b)},
+				NodeConf{Key: "c", Static: false, Required: true, Builder: c.Build},
+			},
+			BuildLock: BuildLockConf{
+				TTL:          time.Second,
+				Wait:         tc.wait,
+				PollInterval: 5 * time.Millisecond,
+			},
+		}
+
+		holder, _ := NewResponseBuilderWithConfig(storage, conf)
+		holderReady := make(chan bool, 1)
+		holder.BuildAsync(context.Background(), nil, holderReady)
+		time.Sleep(5 * time.Millisecond)
+
+		rb, _ := NewResponseBuilderWithConfig(storage, conf)
+		buildAndWait(t, rb)
+		<-holderReady
+
+		if a.Calls() != tc.wantACalls || b.Calls() != 1 || c.Calls() != 2 {
+			t.Errorf("%s: unexpected calls a: %d, b: %d, c: %d", tc.name, a.Calls(),
+				b.Calls(), c.Calls())
+			continue
+		}
+		output := rb.Result()
+		if output["a"] != "a" || output["c"] != "c" {
+			t.Errorf("%s: unexpected output %#v", tc.name, output)
+			continue
+		}
+		report := rb.Report()
+		if n, _ := report.Node("b"); n.Err != tc.wantBErr {
+			t.Errorf("%s: b error, want %v, got %v", tc.name, tc.wantBErr, n.Err)
+			continue
+		}
+
+		// only the lock holder saves the nodes, and releases the lock
+		if len(storage.sets) != 1 {
+			t.Errorf("%s: Set calls, want 1, got %d", tc.name, len(storage.sets))
+		}
+		ok, _ := storage.SetNX(context.Background(), "test_response.lock",
+			[]byte("x"), time.Second)
+		if !ok {
+			t.Errorf("%s: the lock should be released", tc.name)
+		}
+	}
+}
+
+func Test_BuilderFallbackNodes(t *testing.T) {
+	errBuild := fmt.Errorf("build failed")
+	conf := BuilderConfig{
+		StorageKey: "test_response",
+		Nodes: []NodeConf{
+			NodeConf{
+				Key:      "customer",
+				Static:   true,
+				Required: true,
+				Builder:  newTestValueNodeBuilder(1, "c1"),
+			},
+			NodeConf{
+				Key:      "banner",
+				Static:   true,
+				Builder:  newTestDelayedNodeBuilder(1, errBuild),
+				Fallback: "default banner",
+			},
+			NodeConf{
+				Key:        "suggestions",
+				Timeout:    5 * time.Millisecond,
+				Builder:    newTestValueNodeBuilder(50, []string{"s1"}),
+				FallbackFn: func() interface{} { return []string{} },
+			},
+			NodeConf{
+				Key:       "products",
+				DependsOn: []string{"banner"},
+				Builder:   newTestValueNodeBuilder(1, "p1"),
+			},
+		},
+	}
+
+	storage := NewInMemKeyValStorage()
+	rb, err := NewResponseBuilderWithConfig(storage, conf)
+	if err != nil {
+		t.Errorf("unexpected error %s", err.Error())
+		return
+	}
+	if buildAndWait(t, rb) {
+		t.Errorf("the build should report the failed nodes")
+		return
+	}
+
+	res := rb.Result()
+	if len(res) != 3 || res["banner"] != "default banner" {
+		t.Errorf("want the fallback value of the failed node, got %v", res)
+		return
+	}
+	if s, ok := res["suggestions"].([]string); !ok || len(s) != 0 {
+		t.Errorf("want the fallback value of the timed out node, got %v", res["suggestions"])
+		return
+	}
+
+	report := rb.Report()
+	banner, _ := report.Node("banner")
+	if banner.Source != SourceFallback || banner.Status != NodeFailed || banner.Err != errBuild {
+		t.Errorf("unexpected banner report %+v", banner)
+		return
+	}
+	suggestions, _ := report.Node("suggestions")
+	if suggestions.Source != SourceFallback || suggestions.Status != NodeTimedOut {
+		t.Errorf("unexpected suggestions report %+v", suggestions)
+		return
+	}
+	if products, _ := report.Node("products"); products.Source != SourceNone {
+		t.Errorf("the dependents of a fallback node should fail, got %+v", products)
+		return
+	}
+
+	// the fallback values are not saved
+	stored, err := rb.storedNodes(context.Background())
+	if err != nil {
+		t.Errorf("unexpected error %s", err.Error())
+		return
+	}
+	if _, ok := stored["customer"]; !ok {
+		t.Errorf("the customer node should be saved")
+		return
+	}
+	if _, ok := stored["banner"]; ok {
+		t.Errorf("the fallback value should not be saved")
+	}
+}
+
+func Test_BuilderFallbackPendingNodes(t *testing.T) {
+	conf := BuilderConfig{
+		StorageKey: "test_response",
+		Nodes: []NodeConf{
+			NodeConf{
+				Key:      "req",
+				Required: true,
+				Builder:  newTestValueNodeBuilder(1, "r"),
+			},
+			NodeConf{
+				Key:      "suggestions",
+				Builder:  newTestValueNodeBuilder(100, []string{"s1"}),
+				Fallback: []string{},
+			},
+			NodeConf{
+				Key:        "banner",
+				Builder:    newTestDelayedNodeBuilder(1, fmt.Errorf("build failed")),
+				FallbackFn: func() interface{} { panic("no banner") },
+			},
+		},
+		GracePeriod: 10 * time.Millisecond,
+	}
+
+	rb, err := NewResponseBuilderWithConfig(NewNopKeyValStorage(), conf)
+	if err != nil {
+		t.Errorf("unexpected error %s", err.Error())
+		return
+	}
+	res, err := rb.Build(context.Background())
+	if err != nil {
+		t.Errorf("unexpected error %s", err.Error())
+		return
+	}
+	if s, ok := res["suggestions"].([]string); !ok || len(s) != 0 {
+		t.Errorf("want the fallback value of the pending node, got %v", res)
+		return
+	}
+	report := rb.Report()
+	if n, _ := report.Node("suggestions"); n.Source != SourceFallback || n.Status != NodePending {
+		t.Errorf("unexpected suggestions report %+v", n)
+		return
+	}
+
+	// a panic in the fallback function leaves the node without a value
+	if _, ok := res["banner"]; ok {
+		t.Errorf("the banner should not have a value, got %v", res["banner"])
+		return
+	}
+
+	// the built value replaces the fallback one
+	time.Sleep(120 * time.Millisecond)
+	if s, ok := rb.Result()["suggestions"].([]string); !ok || len(s) != 1 {
+		t.Errorf("want the built value, got %v", rb.Result()["suggestions"])
+	}
+}
+
+func Test_BuilderFallbackFnCalledOnce(t *testing.T) {
+	var calls int32
+	conf := BuilderConfig{
+		StorageKey: "test_response",
+		Nodes: []NodeConf{
+			NodeConf{
+				Key:      "req",
+				Required: true,
+				Builder:  newTestValueNodeBuilder(1, "r"),
+			},
+			// the node fails while its fallback is computed for Build
+			NodeConf{
+				Key:     "banner",
+				Builder: newTestDelayedNodeBuilder(15, fmt.Errorf("build failed")),
+				FallbackFn: func() interface{} {
+					atomic.AddInt32(&calls, 1)
+					time.Sleep(30 * time.Millisecond)
+					return "default"
+				},
+			},
+		},
+		GracePeriod: 5 * time.Millisecond,
+	}
+
+	rb, err := NewResponseBuilderWithConfig(NewNopKeyValStorage(), conf)
+	if err != nil {
+		t.Errorf("unexpected error %s", err.Error())
+		return
+	}
+	res, err := rb.Build(context.Background())
+	if err != nil || res["banner"] != "default" {
+		t.Errorf("want the fallback value, got %v (%v)", res, err)
+		return
+	}
+	time.Sleep(50 * time.Millisecond)
+	if n := atomic.LoadInt32(&calls); n != 1 {
+		t.Errorf("fallback calls, want 1, got %d", n)
+	}
+}
+
+func Test_BuilderStaleNodesDoNotExtendStaticTTL(t *testing.T) {
+	storage := NewInMemKeyValStorage()
+	static := &countingNodeBuilder{val: "s"}
+	conf := BuilderConfig{
+		StorageKey: "test_response",
+		StorageTTL: 60 * time.Millisecond,
+		Nodes: []NodeConf{
+			NodeConf{
+				Key:      "static",
+				Static:   true,
+				Required: true,
+				Builder:  static.Build,
+			},
+			NodeConf{
+				Key:          "dyn",
+				StaleAllowed: true,
+				Builder:      newTestValueNodeBuilder(1, "d"),
+			},
+		},
+	}
+
+	// the dynamic node is saved on each build, but the static one
+	// expires anyway
+	for i := 0; i < 6; i++ {
+		rb, err := NewResponseBuilderWithConfig(storage, conf)
+		if err != nil {
+			t.Errorf("unexpected error %s", err.Error())
+			return
+		}
+		if !buildAndWait(t, rb) {
+			t.Errorf("build %d failed", i)
+			return
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	if static.Calls() < 3 {
+		t.Errorf("static builds, want at least 3, got %d", static.Calls())
+	}
+}
+
+// ctxLockStorage is an InMemStorage that fails the writes once their
+// context is done, as a remote storage would
+type ctxLockStorage struct {
+	*InMemStorage
+}
+
+func (s *ctxLockStorage) Set(ctx context.Context, key string, val []byte) error {
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return s.InMemStorage.Set(ctx, key, val)
+}
+
+func (s *ctxLockStorage) SetWithTTL(ctx context.Context, key string, val []byte,
+	ttl time.Duration) error {
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return s.InMemStorage.SetWithTTL(ctx, key, val, ttl)
+}
+
+func (s *ctxLockStorage) DelIfEqual(ctx context.Context, key string,
+	val []byte) (bool, error) {
+	if ctx.Err() != nil {
+		return false, ctx.Err()
+	}
+	return s.InMemStorage.DelIfEqual(ctx, key, val)
+}
+
+func Test_BuilderSavesAfterCancel(t *testing.T) {
+	storage := &ctxLockStorage{NewInMemKeyValStorage()}
+	conf := BuilderConfig{
+		StorageKey: "test_response",
+		Nodes: []NodeConf{
+			NodeConf{
+				Key:      "static",
+				Static:   true,
+				Required: true,
+				Builder:  newTestValueNodeBuilder(1, "s"),
+			},
+			NodeConf{
+				Key:     "slow",
+				Builder: newTestValueNodeBuilder(200, "d"),
+			},
+		},
+		BuildLock: BuildLockConf{TTL: time.Minute},
+	}
+	rb, err := NewResponseBuilderWithConfig(storage, conf)
+	if err != nil {
+		t.Errorf("unexpected error %s", err.Error())
+		return
+	}
+
+	// the handler cancels the context once Build returns
+	ctx, cancel := context.WithCancel(context.Background())
+	_, err = rb.Build(ctx)
+	cancel()
+	if err != nil {
+		t.Errorf("unexpected error %s", err.Error())
+		return
+	}
+
+	var saved, lock []byte
+	for i := 0; i < 100 && (len(saved) == 0 || len(lock) > 0); i++ {
+		time.Sleep(time.Millisecond)
+		saved, _ = storage.Get(context.Background(), "test_response")
+		lock, _ = storage.Get(context.Background(), "test_response.lock")
+	}
+	if len(saved) == 0 {
+		t.Errorf("the static node should be saved")
+		return
+	}
+	if len(lock) > 0 {
+		t.Errorf("the build lock should be released")
+	}
+}
+
+func Test_BuilderBuildLockNotSupported(t *testing.T) {
+	lock := BuildLockConf{TTL: time.Minute}
+	for _, tc := range []struct {
+		name    string
+		storage KeyValStorage
+		wantErr error
+	}{
+		{name: "nop", storage: NewNopKeyValStorage(), wantErr: ErrLocksNotSupported},
+		{name: "in_mem", storage: NewInMemKeyValStorage()},
+		{
+			name: "tiered",
+			storage: NewTieredKeyValStorage(NewLRUKeyValStorage(10, 0),
+				NewInMemKeyValStorage(), TieredConf{}),
+		},
+		{
+			name: "tiered_nop",
+			storage: NewTieredKeyValStorage(NewInMemKeyValStorage(),
+				NewNopKeyValStorage(), TieredConf{}),
+			wantErr: ErrLocksNotSupported,
+		},
+		{
+			name: "breaker",
+			storage: NewBreakerKeyValStorage(NewInMemKeyValStorage(),
+				NewCircuitBreaker("storage", BreakerConf{})),
+		},
+		{
+			name: "breaker_nop",
+			storage: NewBreakerKeyValStorage(NewNopKeyValStorage(),
+				NewCircuitBreaker("storage", BreakerConf{})),
+			wantErr: ErrLocksNotSupported,
+		},
+	} {
+		_, err := NewResponseBuilderWithConfig(tc.storage, BuilderConfig{
+			StorageKey: "test_response",
+			BuildLock:  lock,
+		})
+		if !errors.Is(err, tc.wantErr) {
+			t.Errorf("%s: want error %v, got %v", tc.name, tc.wantErr, err)
+			return
+		}
+	}
+}
+
+func Test_BuilderBuildLockReleasedWithStaticNodes(t *testing.T) {
+	storage := newCountingLockStorage()
+	b := &countingNodeBuilder{val: "b"}
+	conf := BuilderConfig{
+		StorageKey: "test_response",
+		Nodes: []NodeConf{
+			NodeConf{
+				Key:      "a",
+				Static:   true,
+				Required: true,
+				Builder:  newTestValueNodeBuilder(1, "a"),
+			},
+			NodeConf{Key: "b", Static: true, Builder: b.Build},
+			NodeConf{Key: "slow", Builder: newTestValueNodeBuilder(200, "s")},
+		},
+		BuildLock: BuildLockConf{
+			TTL:          time.Second,
+			Wait:         100 * time.Millisecond,
+			PollInterval: 5 * time.Millisecond,
+		},
+	}
+
+	holder, _ := NewResponseBuilderWithConfig(storage, conf)
+	holderReady := make(chan bool, 1)
+	holder.BuildAsync(context.Background(), nil, holderReady)
+	defer func() { <-holderReady }()
+	time.Sleep(5 * time.Millisecond)
+
+	// the holder does not wait for its slow dynamic node to save the
+	// static ones
+	conf.Nodes[2].Builder = newTestValueNodeBuilder(1, "s")
+	rb, _ := NewResponseBuilderWithConfig(storage, conf)
+	start := time.Now()
+	if !buildAndWait(t, rb) {
+		t.Errorf("build failed")
+		return
+	}
+	if time.Since(start) > 80*time.Millisecond {
+		t.Errorf("should not wait for the dynamic nodes of the lock holder")
+		return
+	}
+	if b.Calls() != 1 || rb.Result()["b"] != "b" {
+		t.Errorf("want the optional static node from the lock holder, got %d calls",
+			b.Calls())
+	}
 }
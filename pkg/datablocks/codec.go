@@ -0,0 +1,308 @@
+package datablocks
+
+import (
+	"bytes"
+	"encoding"
+	"encoding/binary"
+	"encoding/gob"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"time"
+)
+
+// Codec serializes the results of the static nodes to save them in the
+// storage, and deserializes them when they are restored.
+type Codec interface {
+	// Name identifies the codec in the stored data, so data written with
+	// another codec is never decoded with this one.
+	Name() string
+	Marshal(v interface{}) ([]byte, error)
+	// Unmarshal decodes data into v, that must be a non nil pointer.
+	Unmarshal(data []byte, v interface{}) error
+}
+
+// DefaultCodec is the codec used when none is configured
+var DefaultCodec Codec = JSONCodec{}
+
+// ErrCodecNeedsType is returned by the codecs that cannot decode into an
+// empty interface, because the data does not carry its own type.
+var ErrCodecNeedsType = errors.New("codec needs a typed value to decode into")
+
+// JSONCodec uses encoding/json. Decoding into an empty interface
+// produces the generic json types (map[string]interface{}, []interface{},
+// float64, ...).
+type JSONCodec struct{}
+
+func (JSONCodec) Name() string {
+	return "json"
+}
+
+func (JSONCodec) Marshal(v interface{}) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+func (JSONCodec) Unmarshal(data []byte, v interface{}) error {
+	return json.Unmarshal(data, v)
+}
+
+// GobCodec uses encoding/gob. Values are encoded as interfaces, so they
+// can be decoded back into their concrete type, but that requires the
+// concrete types to be registered with `gob.Register`.
+type GobCodec struct{}
+
+func (GobCodec) Name() string {
+	return "gob"
+}
+
+func (GobCodec) Marshal(v interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(&v); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (GobCodec) Unmarshal(data []byte, v interface{}) error {
+	var decoded interface{}
+	if err := gob.NewDecoder(bytes.NewReader(data)).Decode(&decoded); err != nil {
+		return err
+	}
+	return assignDecoded(v, decoded)
+}
+
+// BinaryCodec is a compact codec for the values that implement
+// encoding.BinaryMarshaler (and its pointer encoding.BinaryUnmarshaler),
+// []byte and string values, and the fixed size values supported by
+// encoding/binary (numbers, and structs or arrays of them).
+//
+// The encoded data does not carry any type information, so it cannot
+// be decoded into an empty interface.
+type BinaryCodec struct{}
+
+func (BinaryCodec) Name() string {
+	return "binary"
+}
+
+func (BinaryCodec) Marshal(v interface{}) ([]byte, error) {
+	switch val := v.(type) {
+	case encoding.BinaryMarshaler:
+		return val.MarshalBinary()
+	case []byte:
+		return val, nil
+	case string:
+		return []byte(val), nil
+	}
+	var buf bytes.Buffer
+	if err := binary.Write(&buf, binary.LittleEndian, v); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (BinaryCodec) Unmarshal(data []byte, v interface{}) error {
+	switch val := v.(type) {
+	case *interface{}:
+		return ErrCodecNeedsType
+	case encoding.BinaryUnmarshaler:
+		return val.UnmarshalBinary(data)
+	case *[]byte:
+		*val = append([]byte{}, data...)
+		return nil
+	case *string:
+		*val = string(data)
+		return nil
+	}
+	return binary.Read(bytes.NewReader(data), binary.LittleEndian, v)
+}
+
+// assignDecoded sets the value pointed by v to decoded, dereferencing
+// decoded if it is a pointer to the type of the value pointed by v.
+func assignDecoded(v interface{}, decoded interface{}) error {
+	dst := reflect.ValueOf(v)
+	if dst.Kind() != reflect.Ptr || dst.IsNil() {
+		return fmt.Errorf("cannot decode into non pointer %T", v)
+	}
+	dst = dst.Elem()
+
+	src := reflect.ValueOf(decoded)
+	if !src.IsValid() {
+		dst.Set(reflect.Zero(dst.Type()))
+		return nil
+	}
+	if src.Type().AssignableTo(dst.Type()) {
+		dst.Set(src)
+		return nil
+	}
+	if src.Kind() == reflect.Ptr && !src.IsNil() &&
+		src.Elem().Type().AssignableTo(dst.Type()) {
+		dst.Set(src.Elem())
+		return nil
+	}
+	return fmt.Errorf("cannot decode %T into %T", decoded, v)
+}
+
+// decodeNodeResult decodes the data of a node into a value of the type
+// returned by newResult, or into an empty interface if newResult is nil.
+//
+// If newResult returns a pointer, the data is decoded into it, otherwise
+// a pointer to a new value of the same type is used.
+func decodeNodeResult(codec Codec, data []byte,
+	newResult func() interface{}) (interface{}, error) {
+
+	if newResult == nil {
+		var val interface{}
+		err := codec.Unmarshal(data, &val)
+		return val, err
+	}
+
+	val := newResult()
+	rv := reflect.ValueOf(val)
+	if !rv.IsValid() {
+		return nil, fmt.Errorf("NewResult returned a nil interface")
+	}
+	if rv.Kind() == reflect.Ptr && !rv.IsNil() {
+		err := codec.Unmarshal(data, val)
+		return val, err
+	}
+
+	ptr := reflect.New(rv.Type())
+	if err := codec.Unmarshal(data, ptr.Interface()); err != nil {
+		return nil, err
+	}
+	return ptr.Elem().Interface(), nil
+}
+
+// storedNodesVersion is the version of the format used to save the
+// nodes of a response in the storage (see encodeStoredNodes)
+const storedNodesVersion byte = 1
+
+// storedNode is the encoded result of a node, as saved in the storage
+type storedNode struct {
+	key       string
+	codec     string
+	builtAt   time.Time // zero if unknown
+	expiresAt time.Time // zero if it does not expire
+	data      []byte
+}
+
+// expired tells if the node should not be used anymore
+func (n *storedNode) expired(now time.Time) bool {
+	return !n.expiresAt.IsZero() && !now.Before(n.expiresAt)
+}
+
+// encodeStoredNodes packs the encoded nodes in a single value:
+//
+//	version byte
+//	number of nodes (uvarint)
+//	for each node: key and codec name (each one as a uvarint length
+//	followed by the bytes), the unix time in milliseconds when it was
+//	built (uvarint, 0 if unknown), the one when it expires (uvarint, 0
+//	if it does not expire), and the data (as the key and codec)
+func encodeStoredNodes(nodes []storedNode) []byte {
+	size := 1 + binary.MaxVarintLen64
+	for _, n := range nodes {
+		size += 5*binary.MaxVarintLen64 + len(n.key) + len(n.codec) + len(n.data)
+	}
+
+	b := make([]byte, 0, size)
+	b = append(b, storedNodesVersion)
+	b = appendUvarint(b, uint64(len(nodes)))
+	for _, n := range nodes {
+		b = appendBytes(b, []byte(n.key))
+		b = appendBytes(b, []byte(n.codec))
+		b = appendTime(b, n.builtAt)
+		b = appendTime(b, n.expiresAt)
+		b = appendBytes(b, n.data)
+	}
+	return b
+}
+
+// decodeStoredNodes unpacks the value created with encodeStoredNodes
+func decodeStoredNodes(b []byte) (map[string]storedNode, error) {
+	if len(b) == 0 || b[0] != storedNodesVersion {
+		return nil, fmt.Errorf("unknown stored nodes format")
+	}
+	b = b[1:]
+
+	count, n := binary.Uvarint(b)
+	if n <= 0 || count > uint64(len(b)) {
+		return nil, fmt.Errorf("bad stored nodes count")
+	}
+	b = b[n:]
+
+	nodes := make(map[string]storedNode, count)
+	for i := uint64(0); i < count; i++ {
+		var key, codec, data []byte
+		var err error
+		if key, b, err = readBytes(b); err != nil {
+			return nil, err
+		}
+		if codec, b, err = readBytes(b); err != nil {
+			return nil, err
+		}
+		var builtAt, expiresAt time.Time
+		if builtAt, b, err = readTime(b); err != nil {
+			return nil, err
+		}
+		if expiresAt, b, err = readTime(b); err != nil {
+			return nil, err
+		}
+		if data, b, err = readBytes(b); err != nil {
+			return nil, err
+		}
+		nodes[string(key)] = storedNode{
+			key:       string(key),
+			codec:     string(codec),
+			builtAt:   builtAt,
+			expiresAt: expiresAt,
+			data:      data,
+		}
+	}
+	return nodes, nil
+}
+
+func appendUvarint(b []byte, x uint64) []byte {
+	var buf [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(buf[:], x)
+	return append(b, buf[:n]...)
+}
+
+func appendBytes(b []byte, data []byte) []byte {
+	b = appendUvarint(b, uint64(len(data)))
+	return append(b, data...)
+}
+
+// appendTime appends the unix time in milliseconds (0 for a zero time)
+func appendTime(b []byte, t time.Time) []byte {
+	var millis uint64
+	if !t.IsZero() {
+		millis = uint64(t.UnixMilli())
+	}
+	return appendUvarint(b, millis)
+}
+
+// readTime reads a time written with appendTime, returning it and the
+// remaining bytes
+func readTime(b []byte) (time.Time, []byte, error) {
+	millis, n := binary.Uvarint(b)
+	if n <= 0 {
+		return time.Time{}, nil, fmt.Errorf("bad stored nodes time")
+	}
+	if millis == 0 {
+		return time.Time{}, b[n:], nil
+	}
+	return time.UnixMilli(int64(millis)), b[n:], nil
+}
+
+// readBytes reads a length prefixed slice, returning it and the
+// remaining bytes
+func readBytes(b []byte) ([]byte, []byte, error) {
+	l, n := binary.Uvarint(b)
+	if n <= 0 || l > uint64(len(b)-n) {
+		return nil, nil, fmt.Errorf("bad stored nodes length")
+	}
+	b = b[n:]
+	return b[:l], b[l:], nil
+}
@@ -0,0 +1,241 @@
+package datablocks
+
+import (
+	"context"
+	"encoding/gob"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+)
+
+type testCodecItem struct {
+	Name  string
+	Count int
+}
+
+type testFixedItem struct {
+	ID    int64
+	Price float64
+}
+
+func init() {
+	gob.Register(&testCodecItem{})
+}
+
+func Test_CodecsRoundTrip(t *testing.T) {
+	item := &testCodecItem{Name: "book", Count: 2}
+
+	// json decodes into generic types
+	b, err := JSONCodec{}.Marshal(item)
+	if err != nil {
+		t.Errorf("unexpected error %s", err.Error())
+		return
+	}
+	var generic interface{}
+	if err := (JSONCodec{}).Unmarshal(b, &generic); err != nil {
+		t.Errorf("unexpected error %s", err.Error())
+		return
+	}
+	if m, ok := generic.(map[string]interface{}); !ok || m["Name"] != "book" {
+		t.Errorf("json, want a generic map, got %#v", generic)
+		return
+	}
+
+	// gob keeps the concrete type
+	b, err = GobCodec{}.Marshal(item)
+	if err != nil {
+		t.Errorf("unexpected error %s", err.Error())
+		return
+	}
+	var typed interface{}
+	if err := (GobCodec{}).Unmarshal(b, &typed); err != nil {
+		t.Errorf("unexpected error %s", err.Error())
+		return
+	}
+	if !reflect.DeepEqual(typed, item) {
+		t.Errorf("gob, want %#v, got %#v", item, typed)
+		return
+	}
+	var value testCodecItem
+	if err := (GobCodec{}).Unmarshal(b, &value); err != nil || value != *item {
+		t.Errorf("gob, want %#v, got %#v (%v)", *item, value, err)
+		return
+	}
+
+	// binary needs a typed value
+	fixed := testFixedItem{ID: 3, Price: 9.5}
+	b, err = BinaryCodec{}.Marshal(fixed)
+	if err != nil {
+		t.Errorf("unexpected error %s", err.Error())
+		return
+	}
+	if len(b) != 16 {
+		t.Errorf("binary, want 16 bytes, got %d", len(b))
+	}
+	if err := (BinaryCodec{}).Unmarshal(b, &generic); !errors.Is(err, ErrCodecNeedsType) {
+		t.Errorf("binary, want ErrCodecNeedsType, got %v", err)
+		return
+	}
+	var decodedFixed testFixedItem
+	if err := (BinaryCodec{}).Unmarshal(b, &decodedFixed); err != nil || decodedFixed != fixed {
+		t.Errorf("binary, want %#v, got %#v (%v)", fixed, decodedFixed, err)
+	}
+}
+
+func Test_StoredNodesEncoding(t *testing.T) {
+	nodes := []storedNode{
+		{key: "a", codec: "json", data: []byte(`{"x":1}`)},
+		{key: "b", codec: "gob", data: []byte{}},
+	}
+	decoded, err := decodeStoredNodes(encodeStoredNodes(nodes))
+	if err != nil {
+		t.Errorf("unexpected error %s", err.Error())
+		return
+	}
+	if len(decoded) != 2 {
+		t.Errorf("nodes, want 2, got %d", len(decoded))
+		return
+	}
+	if a := decoded["a"]; a.codec != "json" || string(a.data) != `{"x":1}` {
+		t.Errorf("unexpected node a %#v", a)
+	}
+
+	// truncated data is detected
+	b := encodeStoredNodes(nodes)
+	if _, err := decodeStoredNodes(b[:len(b)-3]); err == nil {
+		t.Errorf("want an error decoding truncated data")
+		return
+	}
+
+	// and so is an unknown version
+	b[0] = storedNodesVersion + 1
+	if _, err := decodeStoredNodes(b); err == nil {
+		t.Errorf("want an error decoding an unknown version")
+	}
+}
+
+func Test_BuilderStoresNodesWithTheirCodec(t *testing.T) {
+	nodesConf := []NodeConf{
+		NodeConf{
+			Key:      "item",
+			Static:   true,
+			Required: true,
+			Builder: func(ctx context.Context, df DataFetcher) (interface{}, error) {
+				return &testCodecItem{Name: "book", Count: 2}, nil
+			},
+			Codec: GobCodec{},
+		},
+		NodeConf{
+			Key:      "other",
+			Static:   true,
+			Required: true,
+			Builder:  newTestDelayedNodeBuilder(1, nil),
+		},
+	}
+
+	storage := NewInMemKeyValStorage()
+	rb, err := NewResponseBuilder("test_response", storage, NewDataFetcherImpl(2), nodesConf, 800)
+	if err != nil {
+		t.Errorf("unexpected error %s", err.Error())
+		return
+	}
+	fullReady := make(chan bool, 1)
+	rb.BuildAsync(context.Background(), nil, fullReady)
+
+	select {
+	case <-fullReady:
+	case <-time.After(time.Second):
+		t.Errorf("time expired")
+		return
+	}
+
+	b, _ := storage.Get(context.Background(), "test_response")
+	stored, err := decodeStoredNodes(b)
+	if err != nil {
+		t.Errorf("unexpected error %s", err.Error())
+		return
+	}
+	if stored["item"].codec != "gob" || stored["other"].codec != "json" {
+		t.Errorf("unexpected codecs %q, %q", stored["item"].codec, stored["other"].codec)
+		return
+	}
+
+	var item interface{}
+	if err := (GobCodec{}).Unmarshal(stored["item"].data, &item); err != nil {
+		t.Errorf("unexpected error %s", err.Error())
+		return
+	}
+	if _, ok := item.(*testCodecItem); !ok {
+		t.Errorf("want a *testCodecItem, got %T", item)
+	}
+}
+
+func Test_DecodeNodeResultWithType(t *testing.T) {
+	b, _ := JSONCodec{}.Marshal(&testCodecItem{Name: "book", Count: 2})
+
+	// pointer types are decoded in the returned value
+	val, err := decodeNodeResult(JSONCodec{}, b,
+		func() interface{} { return &testCodecItem{} })
+	if err != nil {
+		t.Errorf("unexpected error %s", err.Error())
+		return
+	}
+	if item, ok := val.(*testCodecItem); !ok || item.Name != "book" {
+		t.Errorf("want a *testCodecItem, got %#v", val)
+		return
+	}
+
+	// non pointer types keep being non pointers
+	val, err = decodeNodeResult(JSONCodec{}, b,
+		func() interface{} { return testCodecItem{} })
+	if item, ok := val.(testCodecItem); !ok || item.Count != 2 || err != nil {
+		t.Errorf("want a testCodecItem, got %#v (%v)", val, err)
+		return
+	}
+
+	b, _ = JSONCodec{}.Marshal(map[string]string{"delay": "5"})
+	val, err = decodeNodeResult(JSONCodec{}, b,
+		func() interface{} { return map[string]string(nil) })
+	if m, ok := val.(map[string]string); !ok || m["delay"] != "5" || err != nil {
+		t.Errorf("want a map[string]string, got %#v (%v)", val, err)
+		return
+	}
+
+	// without type we get the generic json value
+	val, _ = decodeNodeResult(JSONCodec{}, b, nil)
+	if _, ok := val.(map[string]interface{}); !ok {
+		t.Errorf("want a map[string]interface{}, got %#v", val)
+		return
+	}
+
+	// binary codec works with a type
+	fixed := testFixedItem{ID: 3, Price: 9.5}
+	b, _ = BinaryCodec{}.Marshal(fixed)
+	val, err = decodeNodeResult(BinaryCodec{}, b,
+		func() interface{} { return &testFixedItem{} })
+	if item, ok := val.(*testFixedItem); !ok || *item != fixed || err != nil {
+		t.Errorf("want a *testFixedItem, got %#v (%v)", val, err)
+	}
+}
+
+func Test_StoredNodesExpiration(t *testing.T) {
+	now := time.UnixMilli(time.Now().UnixMilli())
+	decoded, err := decodeStoredNodes(encodeStoredNodes([]storedNode{
+		{key: "a", codec: "json", builtAt: now, expiresAt: now.Add(time.Minute), data: []byte("1")},
+		{key: "b", codec: "json", builtAt: now, data: []byte("2")},
+	}))
+	if err != nil {
+		t.Errorf("unexpected error %s", err.Error())
+		return
+	}
+	a, b := decoded["a"], decoded["b"]
+	if !a.builtAt.Equal(now) || !a.expiresAt.Equal(now.Add(time.Minute)) ||
+		a.expired(now) || !a.expired(now.Add(time.Hour)) {
+		t.Errorf("unexpected node a %#v", a)
+		return
+	}
+	if !b.expiresAt.IsZero() || b.expired(now.Add(time.Hour)) {
+		t.Errorf("unexpected node b %#v", b)
+	}
+}
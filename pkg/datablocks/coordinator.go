@@ -0,0 +1,83 @@
+package datablocks
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// BuildCoordinator is shared by the response builders of a process, so
+// the ones with the same storage key that are built at the same time
+// (i.e: a burst of requests before the storage is warm) share the build
+// of their static nodes: each static node is built by the first builder
+// that needs it, and the rest wait for its result. Dynamic nodes are
+// always built by each builder.
+type BuildCoordinator struct {
+	mut   sync.Mutex
+	calls map[coordinatedKey]*sharedCall
+}
+
+// coordinatedKey identifies a node of a response
+type coordinatedKey struct {
+	storageKey string
+	nodeKey    string
+}
+
+// NewBuildCoordinator creates a BuildCoordinator (see
+// BuilderConfig.Coordinator)
+func NewBuildCoordinator() *BuildCoordinator {
+	return &BuildCoordinator{
+		calls: make(map[coordinatedKey]*sharedCall),
+	}
+}
+
+// do calls build if there is no in flight build for the node, or waits
+// for the in flight one, returning true if the result was shared. When
+// the build we are waiting for fails because the context of its builder
+// is done, the node is built again with our context.
+// We wait for the in flight build at most timeout (the node timeout of
+// our builder, <= 0 means no limit), failing with a *NodeTimeoutError.
+func (c *BuildCoordinator) do(ctx context.Context, storageKey string, nodeKey string,
+	timeout time.Duration,
+	build func(ctx context.Context) (interface{}, error)) (interface{}, bool, error) {
+
+	var expired <-chan time.Time
+	if timeout > 0 {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		expired = timer.C
+	}
+
+	key := coordinatedKey{storageKey: storageKey, nodeKey: nodeKey}
+	for {
+		c.mut.Lock()
+		call, ok := c.calls[key]
+		if !ok {
+			call = &sharedCall{done: make(chan struct{})}
+			c.calls[key] = call
+			c.mut.Unlock()
+
+			call.res, call.err = build(ctx)
+			call.leaderCancelled = call.err != nil && ctx.Err() != nil
+
+			c.mut.Lock()
+			delete(c.calls, key)
+			close(call.done)
+			c.mut.Unlock()
+			return call.res, false, call.err
+		}
+		c.mut.Unlock()
+
+		select {
+		case <-call.done:
+		case <-ctx.Done():
+			return nil, true, ctx.Err()
+		case <-expired:
+			return nil, true, &NodeTimeoutError{Key: nodeKey, Timeout: timeout}
+		}
+		if call.err != nil && call.leaderCancelled && ctx.Err() == nil {
+			continue
+		}
+		return call.res, true, call.err
+	}
+}
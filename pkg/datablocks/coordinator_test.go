@@ -0,0 +1,133 @@
+package datablocks
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+func Test_BuildCoordinatorSharesStaticNodes(t *testing.T) {
+	const numBuilders = 5
+	static := &countingNodeBuilder{val: "static"}
+	dynamic := &countingNodeBuilder{val: "dynamic"}
+	slowStatic := func(ctx context.Context, df DataFetcher) (interface{}, error) {
+		time.Sleep(20 * time.Millisecond)
+		return static.Build(ctx, df)
+	}
+	conf := BuilderConfig{
+		StorageKey: "test_response",
+		Nodes: []NodeConf{
+			NodeConf{Key: "static", Static: true, Required: true, Builder: slowStatic},
+			NodeConf{Key: "dynamic", Static: false, Required: true, Builder: dynamic.Build},
+		},
+		Coordinator: NewBuildCoordinator(),
+	}
+	storage := newCountingStorage(NewInMemKeyValStorage())
+
+	var wg sync.WaitGroup
+	reports := make(chan BuildReport, numBuilders)
+	for i := 0; i < numBuilders; i++ {
+		rb, err := NewResponseBuilderWithConfig(storage, conf)
+		if err != nil {
+			t.Errorf("unexpected error %s", err.Error())
+			return
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if !buildAndWait(t, rb) {
+				t.Errorf("want all the nodes built")
+			}
+			if output := rb.Result(); output["static"] != "static" {
+				t.Errorf("unexpected static node %#v", output["static"])
+			}
+			reports <- rb.Report()
+		}()
+	}
+	wg.Wait()
+	close(reports)
+
+	if static.Calls() != 1 || dynamic.Calls() != numBuilders {
+		t.Errorf("calls, want 1 static and %d dynamic, got %d and %d", numBuilders,
+			static.Calls(), dynamic.Calls())
+		return
+	}
+
+	sources := map[NodeSource]int{}
+	for report := range reports {
+		n, _ := report.Node("static")
+		sources[n.Source] += 1
+	}
+	if sources[SourceBuilt] != 1 || sources[SourceShared] != numBuilders-1 {
+		t.Errorf("unexpected static node sources %v", sources)
+	}
+
+	// only the builder that built the static node saves it
+	if len(storage.sets) != 1 {
+		t.Errorf("storage writes, want 1, got %d", len(storage.sets))
+	}
+}
+
+func Test_BuildCoordinatorLeaderCancelled(t *testing.T) {
+	c := NewBuildCoordinator()
+	calls := 0
+	build := func(ctx context.Context) (interface{}, error) {
+		calls += 1
+		select {
+		case <-time.After(20 * time.Millisecond):
+			return "built", nil
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+
+	leaderCtx, cancel := context.WithCancel(context.Background())
+	leaderDone := make(chan struct{})
+	go func() {
+		defer close(leaderDone)
+		c.do(leaderCtx, "test_response", "static", 0, build)
+	}()
+	time.AfterFunc(5*time.Millisecond, cancel)
+
+	time.Sleep(time.Millisecond)
+	res, shared, err := c.do(context.Background(), "test_response", "static", 0, build)
+	<-leaderDone
+	if err != nil || res != "built" || shared {
+		t.Errorf("want the node built again, got %v, %v, %v", res, shared, err)
+		return
+	}
+	if calls != 2 {
+		t.Errorf("calls, want 2, got %d", calls)
+	}
+}
+
+func Test_BuildCoordinatorFollowerTimeout(t *testing.T) {
+	c := NewBuildCoordinator()
+	build := func(ctx context.Context) (interface{}, error) {
+		time.Sleep(50 * time.Millisecond)
+		return "built", nil
+	}
+
+	leaderDone := make(chan struct{})
+	go func() {
+		defer close(leaderDone)
+		c.do(context.Background(), "test_response", "static", 0, build)
+	}()
+	defer func() { <-leaderDone }()
+
+	// the follower gives up after its own node timeout
+	time.Sleep(time.Millisecond)
+	start := time.Now()
+	_, _, err := c.do(context.Background(), "test_response", "static",
+		10*time.Millisecond, build)
+	var timeoutErr *NodeTimeoutError
+	if !errors.As(err, &timeoutErr) || timeoutErr.Key != "static" {
+		t.Errorf("want a NodeTimeoutError, got %v", err)
+		return
+	}
+	if time.Since(start) > 40*time.Millisecond {
+		t.Errorf("the follower should not wait for the leader")
+	}
+}
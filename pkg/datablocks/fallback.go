@@ -0,0 +1,66 @@
+package datablocks
+
+import (
+	"context"
+	"fmt"
+)
+
+// FetchTier tells which source produced the result of a fetch (see
+// AsyncFetchReq.Fallbacks): TierPrimary for the fetcher, n for the
+// n-th fallback, and TierDefault for the default value.
+type FetchTier int
+
+const (
+	TierPrimary FetchTier = 0
+	TierDefault FetchTier = -1
+)
+
+func (t FetchTier) String() string {
+	switch t {
+	case TierPrimary:
+		return "primary"
+	case TierDefault:
+		return "default"
+	}
+	return fmt.Sprintf("fallback_%d", int(t))
+}
+
+// Degraded tells if the result does not come from the primary fetcher
+func (d *AsyncFetchData) Degraded() bool {
+	return d.Tier != TierPrimary
+}
+
+// fetchWithFallbacks fetches the request with its retries, and when it
+// fails (or does not finish within the primary timeout) tries the
+// fallbacks in order, and finally the default value. It returns the
+// attempts of the primary fetcher, the tier of the result and, when all
+// of them fail, the error of the primary fetcher.
+func fetchWithFallbacks(ctx context.Context, req *AsyncFetchReq, limiter *FetchLimiter,
+	breakers *CircuitBreakers) (interface{}, int, FetchTier, error) {
+
+	primaryCtx := ctx
+	if req.PrimaryTimeout > 0 {
+		var cancel context.CancelFunc
+		primaryCtx, cancel = context.WithTimeout(ctx, req.PrimaryTimeout)
+		defer cancel()
+	}
+	res, attempts, err := fetchWithRetries(primaryCtx, req, limiter, breakers)
+	if err == nil {
+		return res, attempts, TierPrimary, nil
+	}
+
+	for idx, fallback := range req.Fallbacks {
+		if ctx.Err() != nil {
+			break
+		}
+		fbRes, fbErr := callFetcher(ctx, req.Hash, fallback)
+		if fbErr == nil {
+			return fbRes, attempts, FetchTier(idx + 1), nil
+		}
+		// TODO: log the fallback error
+	}
+	if req.Default != nil {
+		return req.Default, attempts, TierDefault, nil
+	}
+	return res, attempts, TierPrimary, err
+}
@@ -0,0 +1,127 @@
+package datablocks
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// newTestFallbackFn returns a fetcher that returns res and err, counting
+// its calls in calls
+func newTestFallbackFn(calls *int32, res interface{}, err error) DataFetcherFn {
+	return func(ctx context.Context) (interface{}, error) {
+		atomic.AddInt32(calls, 1)
+		return res, err
+	}
+}
+
+func Test_FetcherFallbacks(t *testing.T) {
+	var primary, first, second int32
+	req := &AsyncFetchReq{
+		Hash:    "Customer_1",
+		Fetcher: newTestFallbackFn(&primary, nil, errTestDown),
+		Fallbacks: []DataFetcherFn{
+			newTestFallbackFn(&first, nil, errTestDown),
+			newTestFallbackFn(&second, "replica", nil),
+		},
+		Default: "default",
+	}
+	res, _ := NewDataFetcherImpl(1).WaitForFetch(context.Background(), req)
+	if res.Err != nil || res.Result != "replica" || res.Tier != 2 || !res.Degraded() {
+		t.Errorf("unexpected fetch data %+v", res)
+		return
+	}
+	if res.Tier.String() != "fallback_2" {
+		t.Errorf("tier, want fallback_2, got %s", res.Tier)
+		return
+	}
+	if primary != 1 || first != 1 || second != 1 {
+		t.Errorf("calls, want 1 each, got %d, %d and %d", primary, first, second)
+		return
+	}
+
+	// the fallbacks are not called when the fetcher succeeds
+	req.Hash = "Customer_2"
+	req.Fetcher = newTestFallbackFn(&primary, "primary", nil)
+	res, _ = NewDataFetcherImpl(1).WaitForFetch(context.Background(), req)
+	if res.Err != nil || res.Result != "primary" || res.Degraded() {
+		t.Errorf("unexpected fetch data %+v", res)
+		return
+	}
+	if first != 1 || second != 1 {
+		t.Errorf("the fallbacks should not be called")
+	}
+}
+
+func Test_FetcherFallbackPrimaryTimeout(t *testing.T) {
+	var calls int32
+	req := &AsyncFetchReq{
+		Hash: "Customer_1",
+		Fetcher: func(ctx context.Context) (interface{}, error) {
+			select {
+			case <-time.After(time.Second):
+				return "primary", nil
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			}
+		},
+		Fallbacks:      []DataFetcherFn{newTestFallbackFn(&calls, "cache", nil)},
+		PrimaryTimeout: 10 * time.Millisecond,
+	}
+
+	start := time.Now()
+	res, _ := NewDataFetcherImpl(1).WaitForFetch(context.Background(), req)
+	if res.Err != nil || res.Result != "cache" || res.Tier != 1 {
+		t.Errorf("unexpected fetch data %+v", res)
+		return
+	}
+	if time.Since(start) > 100*time.Millisecond {
+		t.Errorf("should not wait for the primary fetcher")
+	}
+}
+
+func Test_FetcherFallbackDefault(t *testing.T) {
+	var calls int32
+	req := &AsyncFetchReq{
+		Hash:      "Customer_1",
+		Fetcher:   newTestFallbackFn(&calls, nil, errTestDown),
+		Fallbacks: []DataFetcherFn{newTestFallbackFn(&calls, nil, errors.New("no replica"))},
+		Default:   "default",
+	}
+	res, _ := NewDataFetcherImpl(1).WaitForFetch(context.Background(), req)
+	if res.Err != nil || res.Result != "default" || res.Tier != TierDefault {
+		t.Errorf("unexpected fetch data %+v", res)
+		return
+	}
+
+	// without a default, it fails with the error of the fetcher
+	req.Hash = "Customer_2"
+	req.Default = nil
+	res, _ = NewDataFetcherImpl(1).WaitForFetch(context.Background(), req)
+	if res.Err != errTestDown || res.Result != nil || res.Tier != TierPrimary {
+		t.Errorf("unexpected fetch data %+v", res)
+	}
+}
+
+func Test_SharedFetcherDoesNotKeepFallbacks(t *testing.T) {
+	shared := NewSharedFetcher(SharedFetchConf{DefaultTTL: time.Minute})
+	var primary, fallback int32
+	req := &AsyncFetchReq{
+		Hash:      "Customer_1",
+		Fetcher:   newTestFallbackFn(&primary, nil, errTestDown),
+		Fallbacks: []DataFetcherFn{newTestFallbackFn(&fallback, "cache", nil)},
+	}
+
+	for i := 0; i < 2; i++ {
+		res, _ := NewDataFetcherImplWithShared(1, shared).WaitForFetch(context.Background(), req)
+		if res.Err != nil || res.Result != "cache" || res.Tier != 1 {
+			t.Errorf("unexpected fetch data %+v", res)
+			return
+		}
+	}
+	if primary != 2 {
+		t.Errorf("primary calls, want 2, got %d", primary)
+	}
+}
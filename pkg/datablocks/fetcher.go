@@ -4,6 +4,7 @@ import (
 	"context"
 	"fmt"
 	"sync"
+	"time"
 )
 
 type DataFetcherFn func(c context.Context) (interface{}, error)
@@ -13,6 +14,13 @@ type AsyncFetchData struct {
 	Hash   string
 	Result interface{}
 	Err    error
+	// Attempts is the number of calls to the fetcher (more than one
+	// when the request has a retry or hedge policy), not counting the
+	// fallbacks
+	Attempts int
+	// Tier tells if the result comes from the fetcher, one of the
+	// fallbacks or the default value (see AsyncFetchReq.Fallbacks)
+	Tier FetchTier
 }
 
 // AsyncFechReq provides a function to fetch some data, and
@@ -20,6 +28,31 @@ type AsyncFetchData struct {
 type AsyncFetchReq struct {
 	Fetcher DataFetcherFn
 	Hash    string
+
+	// Family groups the requests of the same type, to configure them
+	// together (i.e: the SharedFetcher TTLs). When empty, the part of
+	// the hash before the first "_" is used.
+	Family string
+
+	// Retry is optional, when set a failed fetch is retried
+	// following the policy
+	Retry *RetryPolicy
+
+	// Hedge is optional, when set a slow fetch is called a second time
+	// following the policy
+	Hedge *HedgePolicy
+
+	// Fallbacks are optional, and tried in order (once each) when the
+	// fetcher fails, or does not finish within PrimaryTimeout (0 means
+	// no timeout other than the context one). When all of them fail,
+	// the Default value is used, if not nil.
+	Fallbacks      []DataFetcherFn
+	PrimaryTimeout time.Duration
+	Default        interface{}
+
+	// batched is set for the items of a Batcher, that do not take a slot
+	// in the limiter (see Batcher.SetLimiter)
+	batched bool
 }
 
 // TODO: we need to convert this interface to a function type definition
@@ -41,6 +74,110 @@ type cachedAsyncData struct {
 	// we need to send the event through the channel once
 	// the in-flight data fetch is finished
 	numPendingNotifications int
+
+	// waiters is the number of callers whose context is not done yet,
+	// when it gets to 0 the fetch is cancelled (and orphaned)
+	ctx      *fetchContext
+	waiters  int
+	orphaned bool
+	done     chan struct{} // closed when the fetch finishes
+}
+
+// fetchContext is the context of an in flight fetch, shared by all the
+// callers waiting for it: it keeps the values of the context of the
+// caller that launched it, its deadline is the latest one of the callers
+// (none if one of them has no deadline), and it is cancelled when all of
+// them leave.
+type fetchContext struct {
+	values context.Context
+	done   chan struct{}
+
+	mut      sync.Mutex
+	deadline time.Time // zero if there is no deadline
+	timer    *time.Timer
+	err      error
+}
+
+func newFetchContext(ctx context.Context) *fetchContext {
+	c := &fetchContext{
+		values: ctx,
+		done:   make(chan struct{}),
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		// the timer can fire before it is assigned
+		c.mut.Lock()
+		c.deadline = deadline
+		c.timer = time.AfterFunc(time.Until(deadline), c.expire)
+		c.mut.Unlock()
+	}
+	return c
+}
+
+func (c *fetchContext) Deadline() (time.Time, bool) {
+	c.mut.Lock()
+	defer c.mut.Unlock()
+	return c.deadline, !c.deadline.IsZero()
+}
+
+func (c *fetchContext) Done() <-chan struct{} {
+	return c.done
+}
+
+func (c *fetchContext) Err() error {
+	c.mut.Lock()
+	defer c.mut.Unlock()
+	return c.err
+}
+
+func (c *fetchContext) Value(key interface{}) interface{} {
+	return c.values.Value(key)
+}
+
+// join extends the deadline with the one of a new caller
+func (c *fetchContext) join(ctx context.Context) {
+	c.mut.Lock()
+	defer c.mut.Unlock()
+	if c.err != nil || c.deadline.IsZero() {
+		return
+	}
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		c.deadline = time.Time{}
+		c.timer.Stop()
+	} else if deadline.After(c.deadline) {
+		c.deadline = deadline
+		c.timer.Reset(time.Until(deadline))
+	}
+}
+
+// expire cancels the context once its deadline is over, unless it was
+// extended in the meantime
+func (c *fetchContext) expire() {
+	c.mut.Lock()
+	defer c.mut.Unlock()
+	if c.deadline.IsZero() || time.Now().Before(c.deadline) {
+		return
+	}
+	c.cancelLocked(context.DeadlineExceeded)
+}
+
+// cancel cancels the context with err, if it is not done yet
+func (c *fetchContext) cancel(err error) {
+	c.mut.Lock()
+	defer c.mut.Unlock()
+	c.cancelLocked(err)
+}
+
+// cancelLocked is cancel with the lock held
+func (c *fetchContext) cancelLocked(err error) {
+	if c.err != nil {
+		return
+	}
+	c.err = err
+	close(c.done)
+	if c.timer != nil {
+		c.timer.Stop()
+	}
 }
 
 // DataFetcherImpl is an implementation of a DataFetcher with in-memory cache
@@ -49,6 +186,13 @@ type DataFetcherImpl struct {
 	dataMut     sync.Mutex
 	data        map[string]*cachedAsyncData
 	dataChanCap int
+
+	// shared is optional, to share the fetches with other requests
+	shared *SharedFetcher
+	// limiter is optional, to limit the concurrent fetches
+	limiter *FetchLimiter
+	// breakers is optional, to fail fast the fetches of failing families
+	breakers *CircuitBreakers
 }
 
 // NewDataFetcherImpl returns a DataFetcher implementation
@@ -69,6 +213,22 @@ func NewDataFetcherImpl(dataChanCap int) *DataFetcherImpl {
 	}
 }
 
+// NewDataFetcherImplWithShared returns a DataFetcher implementation (see
+// NewDataFetcherImpl) that does its fetches through a SharedFetcher, so
+// they are shared with the other requests using it.
+func NewDataFetcherImplWithShared(dataChanCap int, shared *SharedFetcher) *DataFetcherImpl {
+	df := NewDataFetcherImpl(dataChanCap)
+	df.shared = shared
+	return df
+}
+
+// Fetch launches the fetch of the request, or joins the in flight fetch
+// with the same hash, and returns the channel where its result is sent.
+//
+// The fetch is not cancelled by the context of the caller that launched
+// it, but when the contexts of all the callers waiting for it are done,
+// and its deadline is the latest one of the callers. All the callers are
+// notified, even the ones whose context is done.
 func (df *DataFetcherImpl) Fetch(ctx context.Context, req *AsyncFetchReq) (<-chan *AsyncFetchData, error) {
 	if req.Fetcher == nil {
 		return nil, fmt.Errorf("null datafetcher")
@@ -82,13 +242,21 @@ func (df *DataFetcherImpl) Fetch(ctx context.Context, req *AsyncFetchReq) (<-cha
 	}
 
 	var err error
+	waiting := true
 	df.dataMut.Lock()
 	cad, reqExists := df.data[req.Hash]
+	if reqExists && cad.orphaned {
+		// all its callers left and it was cancelled, we fetch it again
+		reqExists = false
+	}
 	if reqExists {
-		if cad.numPendingNotifications > 0 {
+		if cad.fetchedData == nil {
 			// fetching on flight
 			cad.numPendingNotifications += 1
+			cad.waiters += 1
+			cad.ctx.join(ctx)
 		} else {
+			waiting = false
 			// the fetching has finished: if chan would block we launch
 			// a goroutine to block on notification.
 			select {
@@ -102,6 +270,9 @@ func (df *DataFetcherImpl) Fetch(ctx context.Context, req *AsyncFetchReq) (<-cha
 		cad = &cachedAsyncData{
 			notifyChan:              make(chan *AsyncFetchData, df.dataChanCap),
 			numPendingNotifications: 1,
+			ctx:                     newFetchContext(ctx),
+			waiters:                 1,
+			done:                    make(chan struct{}),
 		}
 		df.data[req.Hash] = cad
 	}
@@ -109,32 +280,81 @@ func (df *DataFetcherImpl) Fetch(ctx context.Context, req *AsyncFetchReq) (<-cha
 
 	// if the request was new, we launch a backgroundFetch
 	if !reqExists {
-		go df.backgroundFetch(ctx, cad, req)
+		go df.backgroundFetch(cad.ctx, cad, req)
+	}
+	if waiting && ctx.Done() != nil {
+		go df.watchCaller(ctx, cad)
 	}
 	return cad.notifyChan, err
 }
 
-// backgroundFetch runs in the background to fetch some data
+// watchCaller waits for the context of a caller waiting for a fetch, and
+// when it is done before the fetch finishes, the caller leaves: if it was
+// the last one, the fetch is cancelled with the error of its context.
+func (df *DataFetcherImpl) watchCaller(ctx context.Context, cad *cachedAsyncData) {
+	select {
+	case <-cad.done:
+		return
+	case <-ctx.Done():
+	}
+
+	df.dataMut.Lock()
+	defer df.dataMut.Unlock()
+	if cad.fetchedData != nil || cad.orphaned {
+		return
+	}
+	cad.waiters -= 1
+	if cad.waiters == 0 {
+		cad.orphaned = true
+		cad.ctx.cancel(ctx.Err())
+	}
+}
+
+// SetLimiter sets the FetchLimiter that limits the number of concurrent
+// fetches (nil disables it). It must be called before Fetch.
+func (df *DataFetcherImpl) SetLimiter(limiter *FetchLimiter) {
+	df.limiter = limiter
+}
+
+// SetBreakers sets the CircuitBreakers of the families of the fetches,
+// that fail with ErrCircuitOpen while their breaker is open (nil disables
+// them). It must be called before Fetch.
+func (df *DataFetcherImpl) SetBreakers(breakers *CircuitBreakers) {
+	df.breakers = breakers
+}
+
+// backgroundFetch runs in the background to fetch some data (retrying
+// it if the request has a retry policy, and then trying its fallbacks),
+// a panic in the fetcher is
+// returned as a *PanicError
 func (df *DataFetcherImpl) backgroundFetch(ctx context.Context,
 	cad *cachedAsyncData, req *AsyncFetchReq) {
 
+	defer cad.ctx.cancel(context.Canceled)
 	res := &AsyncFetchData{
 		Hash: req.Hash,
 	}
-	res.Result, res.Err = req.Fetcher(ctx)
+	if df.shared != nil {
+		res.Result, res.Attempts, res.Tier, res.Err = df.shared.fetch(ctx, req,
+			df.limiter, df.breakers)
+	} else {
+		res.Result, res.Attempts, res.Tier, res.Err = fetchWithFallbacks(ctx, req,
+			df.limiter, df.breakers)
+	}
 
 	// we need to lock the results
 	df.dataMut.Lock()
-	if _, ok := df.data[req.Hash]; !ok {
-		// TODO: Log this!: if this happens we have a big bug somewhere
-		df.dataMut.Unlock()
-		return
-	}
+	close(cad.done)
 	// we will notify clients after unlock:
 	numNotifications := cad.numPendingNotifications
 	cad.numPendingNotifications = 0
 	cad.fetchedData = res
-	df.data[res.Hash] = cad
+	if current, ok := df.data[req.Hash]; ok && current == cad &&
+		(cad.orphaned || (res.Err != nil && ctx.Err() != nil)) {
+		// nobody is waiting for this result, or it failed because all
+		// the callers are gone: it will be fetched again if requested
+		delete(df.data, req.Hash)
+	}
 	df.dataMut.Unlock()
 
 	// at this point we do not care if we are blocking on the channel as the
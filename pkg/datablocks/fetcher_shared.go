@@ -0,0 +1,171 @@
+package datablocks
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultSharedSweepInterval time.Duration = time.Minute
+)
+
+// SharedFetchConf holds the configuration for a SharedFetcher
+type SharedFetchConf struct {
+	// TTLs has the time the successful results are kept for each family
+	// of requests (see AsyncFetchReq.Family), and DefaultTTL is used
+	// for the families not in TTLs. A ttl <= 0 means the results are
+	// not kept, and only the in flight fetches are shared.
+	TTLs       map[string]time.Duration
+	DefaultTTL time.Duration
+
+	// SweepInterval is how often the expired results are removed
+	// (DefaultSharedSweepInterval if 0)
+	SweepInterval time.Duration
+}
+
+// SharedFetcher is shared by several DataFetcherImpl (usually one per
+// request) so the fetches with the same hash done at the same time by
+// different requests are done only once, and their results can be kept
+// for some time to be used by the following requests.
+//
+// Failed fetches, and the results of their fallbacks, are never kept.
+type SharedFetcher struct {
+	conf SharedFetchConf
+
+	mut       sync.Mutex
+	calls     map[string]*sharedCall
+	lastSweep time.Time
+}
+
+// sharedCall is an in flight, or finished, fetch
+type sharedCall struct {
+	done chan struct{} // closed when the fetch finishes
+
+	// set before done is closed
+	res             interface{}
+	attempts        int
+	tier            FetchTier
+	err             error
+	leaderCancelled bool // the fetch failed because its ctx was done
+	expiresAt       time.Time
+}
+
+// NewSharedFetcher creates a SharedFetcher, that can be used by
+// DataFetcherImpl created with NewDataFetcherImplWithShared.
+func NewSharedFetcher(conf SharedFetchConf) *SharedFetcher {
+	if conf.SweepInterval <= 0 {
+		conf.SweepInterval = DefaultSharedSweepInterval
+	}
+	return &SharedFetcher{
+		conf:      conf,
+		calls:     make(map[string]*sharedCall),
+		lastSweep: time.Now(),
+	}
+}
+
+// fetch returns the result for the request, from a finished fetch that
+// has not expired, waiting for the in flight one, or fetching it. When
+// the fetch we are waiting for fails because the context of the request
+// that launched it is done, it is launched again with our context.
+func (s *SharedFetcher) fetch(ctx context.Context, req *AsyncFetchReq,
+	limiter *FetchLimiter, breakers *CircuitBreakers) (interface{}, int, FetchTier, error) {
+
+	for {
+		now := time.Now()
+		s.mut.Lock()
+		s.sweep(now)
+		call, ok := s.calls[req.Hash]
+		if ok && call.finished() && !now.Before(call.expiresAt) {
+			delete(s.calls, req.Hash)
+			ok = false
+		}
+		if !ok {
+			call = &sharedCall{done: make(chan struct{})}
+			s.calls[req.Hash] = call
+			s.mut.Unlock()
+			return s.lead(ctx, req, call, limiter, breakers)
+		}
+		s.mut.Unlock()
+
+		select {
+		case <-call.done:
+		case <-ctx.Done():
+			return nil, 0, TierPrimary, ctx.Err()
+		}
+		if call.err != nil && call.leaderCancelled && ctx.Err() == nil {
+			continue
+		}
+		return call.res, call.attempts, call.tier, call.err
+	}
+}
+
+// lead does the fetch for all the requests waiting for the call
+func (s *SharedFetcher) lead(ctx context.Context, req *AsyncFetchReq,
+	call *sharedCall, limiter *FetchLimiter,
+	breakers *CircuitBreakers) (interface{}, int, FetchTier, error) {
+
+	call.res, call.attempts, call.tier, call.err = fetchWithFallbacks(ctx, req,
+		limiter, breakers)
+	call.leaderCancelled = call.err != nil && ctx.Err() != nil
+
+	ttl := s.ttl(req.family())
+	s.mut.Lock()
+	if call.err != nil || call.tier != TierPrimary || ttl <= 0 {
+		if s.calls[req.Hash] == call {
+			delete(s.calls, req.Hash)
+		}
+	} else {
+		call.expiresAt = time.Now().Add(ttl)
+	}
+	close(call.done)
+	s.mut.Unlock()
+
+	return call.res, call.attempts, call.tier, call.err
+}
+
+// finished tells if the fetch of a call has finished
+// (must be called with the lock held)
+func (c *sharedCall) finished() bool {
+	select {
+	case <-c.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// ttl returns the time the results of a family of requests are kept
+func (s *SharedFetcher) ttl(family string) time.Duration {
+	if ttl, ok := s.conf.TTLs[family]; ok {
+		return ttl
+	}
+	return s.conf.DefaultTTL
+}
+
+// sweep removes the expired results, if the sweep interval has passed
+// (must be called with the lock held)
+func (s *SharedFetcher) sweep(now time.Time) {
+	if now.Sub(s.lastSweep) < s.conf.SweepInterval {
+		return
+	}
+	s.lastSweep = now
+	for hash, call := range s.calls {
+		if call.finished() && !now.Before(call.expiresAt) {
+			delete(s.calls, hash)
+		}
+	}
+}
+
+// family returns the family of the request, that defaults to the part
+// of the hash before the first "_" (i.e: "Customer" for "Customer_1234")
+func (r *AsyncFetchReq) family() string {
+	if len(r.Family) > 0 {
+		return r.Family
+	}
+	if idx := strings.Index(r.Hash, "_"); idx >= 0 {
+		return r.Hash[:idx]
+	}
+	return r.Hash
+}
@@ -0,0 +1,152 @@
+package datablocks
+
+import (
+	"context"
+	"fmt"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// newTestCountingFetchReq returns a request that takes millis to return
+// res or err, counting the calls in calls
+func newTestCountingFetchReq(hash string, millis int, calls *int32,
+	res interface{}, err error) *AsyncFetchReq {
+
+	return &AsyncFetchReq{
+		Hash: hash,
+		Fetcher: func(ctx context.Context) (interface{}, error) {
+			atomic.AddInt32(calls, 1)
+			select {
+			case <-time.After(time.Duration(millis) * time.Millisecond):
+				return res, err
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			}
+		},
+	}
+}
+
+func Test_SharedFetcherInFlight(t *testing.T) {
+	shared := NewSharedFetcher(SharedFetchConf{})
+	var calls int32
+
+	// two requests fetching the same data at the same time
+	ctx := context.Background()
+	results := make(chan *AsyncFetchData, 2)
+	for i := 0; i < 2; i++ {
+		df := NewDataFetcherImplWithShared(1, shared)
+		go func() {
+			res, _ := df.WaitForFetch(ctx,
+				newTestCountingFetchReq("Customer_1", 10, &calls, "john", nil))
+			results <- res
+		}()
+	}
+	for i := 0; i < 2; i++ {
+		if res := <-results; res.Result != "john" {
+			t.Errorf("unexpected result %+v", res)
+			return
+		}
+	}
+	if n := atomic.LoadInt32(&calls); n != 1 {
+		t.Errorf("calls, want 1, got %d", n)
+		return
+	}
+
+	// without a ttl the result is not kept
+	df := NewDataFetcherImplWithShared(1, shared)
+	df.WaitForFetch(ctx, newTestCountingFetchReq("Customer_1", 1, &calls, "john", nil))
+	if n := atomic.LoadInt32(&calls); n != 2 {
+		t.Errorf("calls, want 2, got %d", n)
+	}
+}
+
+func Test_SharedFetcherTTLs(t *testing.T) {
+	shared := NewSharedFetcher(SharedFetchConf{
+		TTLs: map[string]time.Duration{
+			"Customer": 20 * time.Millisecond,
+			"Cart":     0,
+		},
+		DefaultTTL: time.Second,
+	})
+	ctx := context.Background()
+	fetch := func(req *AsyncFetchReq) *AsyncFetchData {
+		res, _ := NewDataFetcherImplWithShared(1, shared).WaitForFetch(ctx, req)
+		return res
+	}
+
+	var customerCalls, cartCalls, productCalls, failingCalls int32
+	for i := 0; i < 2; i++ {
+		fetch(newTestCountingFetchReq("Customer_1", 1, &customerCalls, "john", nil))
+		fetch(newTestCountingFetchReq("Cart_1", 1, &cartCalls, "cart", nil))
+		// the family can be set explicitly
+		req := newTestCountingFetchReq("product-1", 1, &productCalls, "product", nil)
+		req.Family = "Product"
+		fetch(req)
+		fetch(newTestCountingFetchReq("Failing_1", 1, &failingCalls, nil,
+			fmt.Errorf("failed")))
+	}
+	want := map[string]int32{
+		"customer": 1,
+		"cart":     2,
+		"product":  1,
+		"failing":  2,
+	}
+	got := map[string]int32{
+		"customer": customerCalls,
+		"cart":     cartCalls,
+		"product":  productCalls,
+		"failing":  failingCalls,
+	}
+	for k, w := range want {
+		if got[k] != w {
+			t.Errorf("%s calls, want %d, got %d", k, w, got[k])
+		}
+	}
+
+	// the customer expires
+	time.Sleep(30 * time.Millisecond)
+	fetch(newTestCountingFetchReq("Customer_1", 1, &customerCalls, "john", nil))
+	if customerCalls != 2 {
+		t.Errorf("customer calls after expiration, want 2, got %d", customerCalls)
+	}
+}
+
+func Test_SharedFetcherLeaderCancelled(t *testing.T) {
+	shared := NewSharedFetcher(SharedFetchConf{})
+	var calls int32
+
+	leaderCtx, cancel := context.WithCancel(context.Background())
+	leaderRes := make(chan *AsyncFetchData, 1)
+	go func() {
+		res, _ := NewDataFetcherImplWithShared(1, shared).WaitForFetch(leaderCtx,
+			newTestCountingFetchReq("Customer_1", 20, &calls, "john", nil))
+		leaderRes <- res
+	}()
+	time.AfterFunc(5*time.Millisecond, cancel)
+
+	// the follower fetches it again when the leader is cancelled
+	time.Sleep(time.Millisecond)
+	res, err := NewDataFetcherImplWithShared(1, shared).WaitForFetch(context.Background(),
+		newTestCountingFetchReq("Customer_1", 20, &calls, "john", nil))
+	if err != nil || res.Err != nil || res.Result != "john" {
+		t.Errorf("unexpected follower result %+v (%v)", res, err)
+		return
+	}
+	if n := atomic.LoadInt32(&calls); n != 2 {
+		t.Errorf("calls, want 2, got %d", n)
+	}
+}
+
+func Test_FetchReqFamily(t *testing.T) {
+	for hash, want := range map[string]string{
+		"Customer_1234":       "Customer",
+		"RelatedProducts_a_b": "RelatedProducts",
+		"nounderscore":        "nounderscore",
+	} {
+		req := &AsyncFetchReq{Hash: hash}
+		if got := req.family(); got != want {
+			t.Errorf("%s, want family %s, got %s", hash, want, got)
+		}
+	}
+}
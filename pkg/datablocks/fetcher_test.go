@@ -2,7 +2,9 @@ package datablocks
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"sync/atomic"
 	"testing"
 	"time"
 )
@@ -114,3 +116,130 @@ func Test_FetcherCachedData(t *testing.T) {
 		return
 	}
 }
+
+type testCtxKey string
+
+func Test_FetcherFirstCallerLeaves(t *testing.T) {
+	df := NewDataFetcherImpl(10)
+	var calls int32
+	var value interface{}
+	req := &AsyncFetchReq{
+		Hash: "Customer_1",
+		Fetcher: func(ctx context.Context) (interface{}, error) {
+			atomic.AddInt32(&calls, 1)
+			value = ctx.Value(testCtxKey("trace"))
+			select {
+			case <-time.After(20 * time.Millisecond):
+				return "ok", nil
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			}
+		},
+	}
+
+	first, cancel := context.WithTimeout(
+		context.WithValue(context.Background(), testCtxKey("trace"), "abc"),
+		5*time.Millisecond)
+	defer cancel()
+	df.Fetch(first, req)
+	recv, _ := df.Fetch(context.Background(), req)
+	if _, err := df.WaitForFetch(first, req); err == nil {
+		t.Errorf("want an error for the first caller")
+		return
+	}
+
+	// the fetch goes on for the caller still waiting
+	var res *AsyncFetchData
+	select {
+	case res = <-recv:
+	case <-time.After(time.Second):
+		t.Errorf("time expired")
+		return
+	}
+	if res.Err != nil || res.Result != "ok" {
+		t.Errorf("unexpected fetch data %+v", res)
+		return
+	}
+	if calls != 1 {
+		t.Errorf("calls, want 1, got %d", calls)
+		return
+	}
+	if value != "abc" {
+		t.Errorf("the fetch should keep the values of the first context, got %v", value)
+	}
+}
+
+func Test_FetcherOrphaned(t *testing.T) {
+	df := NewDataFetcherImpl(10)
+	var calls int32
+	var cancelled int32
+	req := &AsyncFetchReq{
+		Hash: "Customer_1",
+		Fetcher: func(ctx context.Context) (interface{}, error) {
+			atomic.AddInt32(&calls, 1)
+			select {
+			case <-time.After(20 * time.Millisecond):
+				return "ok", nil
+			case <-ctx.Done():
+				atomic.AddInt32(&cancelled, 1)
+				return nil, ctx.Err()
+			}
+		},
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	df.Fetch(ctx, req)
+	recv, _ := df.Fetch(ctx, req)
+	cancel()
+
+	// the callers that left are notified anyway
+	select {
+	case res := <-recv:
+		if !errors.Is(res.Err, context.Canceled) {
+			t.Errorf("want a cancelled fetch, got %+v", res)
+			return
+		}
+	case <-time.After(time.Second):
+		t.Errorf("time expired")
+		return
+	}
+	if atomic.LoadInt32(&cancelled) != 1 {
+		t.Errorf("the fetch should be cancelled")
+		return
+	}
+
+	// the cancelled result is not kept
+	res, err := df.WaitForFetch(context.Background(), req)
+	if err != nil {
+		t.Errorf("unexpected error %s", err.Error())
+		return
+	}
+	if res.Err != nil || res.Result != "ok" {
+		t.Errorf("unexpected fetch data %+v", res)
+		return
+	}
+	if n := atomic.LoadInt32(&calls); n != 2 {
+		t.Errorf("calls, want 2, got %d", n)
+	}
+}
+
+func Test_FetcherLatestDeadline(t *testing.T) {
+	df := NewDataFetcherImpl(10)
+	req := newTestCountingFetchReq("Customer_1", 20, new(int32), "ok", nil)
+
+	first, cancel := context.WithTimeout(context.Background(), 5*time.Millisecond)
+	defer cancel()
+	df.Fetch(first, req)
+
+	// the fetch lives until the deadline of the second caller
+	second, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	res, err := df.WaitForFetch(second, req)
+	if err != nil {
+		t.Errorf("unexpected error %s", err.Error())
+		return
+	}
+	if res.Err != nil || res.Result != "ok" {
+		t.Errorf("unexpected fetch data %+v", res)
+	}
+}
@@ -1,3 +1,3 @@
 module github.com/heetch/datablocks/pkg/datablocks
 
-go 1.17
+go 1.18
@@ -0,0 +1,211 @@
+package datablocks
+
+import (
+	"context"
+	"math"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultHedgePercentile   float64 = 0.95
+	DefaultLatencySamples    int     = 100
+	DefaultLatencyMinSamples int     = 20
+)
+
+// HedgePolicy defines when a slow fetch is hedged (see AsyncFetchReq):
+// if the fetcher has not finished after a delay, it is called a second
+// time, and the first successful result is used while the other call is
+// cancelled.
+//
+// The hedged call is done inside the shared in-flight fetch, so all the
+// callers waiting for the same hash get its result, and it counts as one
+// more attempt in AsyncFetchData.
+type HedgePolicy struct {
+	// Delay is the time to wait for the first call before the hedged
+	// one (a value <= 0 disables hedging, unless it is computed from
+	// the Latencies)
+	Delay time.Duration
+
+	// Latencies is optional, when set the delay is the Percentile
+	// (DefaultHedgePercentile if 0) of the recent latencies of the
+	// family of the request, and Delay is used until it has enough
+	// samples. The latencies of the successful calls are recorded in it.
+	Latencies  *LatencyTracker
+	Percentile float64
+}
+
+// delay returns the time to wait before the hedged call
+func (p *HedgePolicy) delay(family string) time.Duration {
+	percentile := p.Percentile
+	if percentile <= 0 {
+		percentile = DefaultHedgePercentile
+	}
+	if d, ok := p.Latencies.Percentile(family, percentile); ok {
+		return d
+	}
+	return p.Delay
+}
+
+// hedgeOutcome is the result of one of the calls of a hedged fetch
+type hedgeOutcome struct {
+	res interface{}
+	err error
+}
+
+// fetch calls the fetcher, and a second time if the first call takes
+// longer than the delay, returning the first successful result and the
+// number of calls (0 if the first call did not get a slot). Each call
+// waits for its own slot in the limiter (that can be nil), and keeps it
+// until the fetcher returns, even if we already returned.
+func (p *HedgePolicy) fetch(ctx context.Context, req *AsyncFetchReq,
+	limiter *FetchLimiter) (interface{}, int, error) {
+
+	family := req.family()
+	release, err := limiter.acquire(ctx, family)
+	if err != nil {
+		return nil, 0, err
+	}
+	delay := p.delay(family)
+	if delay <= 0 {
+		defer release()
+		res, err := p.call(ctx, family, req)
+		return res, 1, err
+	}
+
+	// the call still running is cancelled once we return
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	outcomes := make(chan hedgeOutcome, 2)
+	go func() {
+		defer release()
+		res, err := p.call(ctx, family, req)
+		outcomes <- hedgeOutcome{res: res, err: err}
+	}()
+
+	calls, pending := 1, 1
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	for {
+		select {
+		case o := <-outcomes:
+			pending -= 1
+			if o.err == nil || pending == 0 {
+				return o.res, calls, o.err
+			}
+		case <-timer.C:
+			calls += 1
+			pending += 1
+			go func() {
+				release, err := limiter.acquire(ctx, family)
+				if err != nil {
+					outcomes <- hedgeOutcome{err: err}
+					return
+				}
+				defer release()
+				res, err := p.call(ctx, family, req)
+				outcomes <- hedgeOutcome{res: res, err: err}
+			}()
+		}
+	}
+}
+
+// call calls the fetcher once, recording its latency if it succeeds
+func (p *HedgePolicy) call(ctx context.Context, family string,
+	req *AsyncFetchReq) (interface{}, error) {
+
+	start := time.Now()
+	res, err := callFetcher(ctx, req.Hash, req.Fetcher)
+	if err == nil {
+		p.Latencies.Record(family, time.Since(start))
+	}
+	return res, err
+}
+
+// LatencyConf holds the configuration for a LatencyTracker
+type LatencyConf struct {
+	// Samples is the number of recent latencies kept for each family
+	// (DefaultLatencySamples if 0)
+	Samples int
+	// MinSamples is the number of latencies needed to compute a
+	// percentile (DefaultLatencyMinSamples if 0)
+	MinSamples int
+}
+
+// LatencyTracker keeps the recent latencies of the fetches of each
+// family, to compute the delay of a HedgePolicy. It is usually shared
+// by all the requests of a process.
+type LatencyTracker struct {
+	conf LatencyConf
+
+	mut      sync.Mutex
+	families map[string]*latencySamples
+}
+
+// latencySamples is a ring buffer with the recent latencies of a family
+type latencySamples struct {
+	samples []time.Duration
+	next    int
+}
+
+// NewLatencyTracker creates a LatencyTracker
+func NewLatencyTracker(conf LatencyConf) *LatencyTracker {
+	if conf.Samples <= 0 {
+		conf.Samples = DefaultLatencySamples
+	}
+	if conf.MinSamples <= 0 {
+		conf.MinSamples = DefaultLatencyMinSamples
+	}
+	return &LatencyTracker{
+		conf:     conf,
+		families: make(map[string]*latencySamples),
+	}
+}
+
+// Record adds the latency of a fetch of the family. A nil LatencyTracker
+// does not record anything.
+func (l *LatencyTracker) Record(family string, d time.Duration) {
+	if l == nil {
+		return
+	}
+	l.mut.Lock()
+	defer l.mut.Unlock()
+	s, ok := l.families[family]
+	if !ok {
+		s = &latencySamples{samples: make([]time.Duration, 0, l.conf.Samples)}
+		l.families[family] = s
+	}
+	if len(s.samples) < l.conf.Samples {
+		s.samples = append(s.samples, d)
+		return
+	}
+	s.samples[s.next] = d
+	s.next = (s.next + 1) % l.conf.Samples
+}
+
+// Percentile returns the percentile p (between 0 and 1) of the recent
+// latencies of the family, and false if there are not enough of them.
+func (l *LatencyTracker) Percentile(family string, p float64) (time.Duration, bool) {
+	if l == nil {
+		return 0, false
+	}
+	l.mut.Lock()
+	s, ok := l.families[family]
+	if !ok || len(s.samples) < l.conf.MinSamples {
+		l.mut.Unlock()
+		return 0, false
+	}
+	sorted := append([]time.Duration{}, s.samples...)
+	l.mut.Unlock()
+
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	idx := int(math.Ceil(p*float64(len(sorted)))) - 1
+	if idx < 0 {
+		idx = 0
+	} else if idx >= len(sorted) {
+		idx = len(sorted) - 1
+	}
+	return sorted[idx], true
+}
@@ -0,0 +1,159 @@
+package datablocks
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// newTestSlowFirstFetchReq returns a request whose first call takes
+// slowMillis and the following ones 1ms, counting the calls in calls
+// and the cancelled ones in cancelled
+func newTestSlowFirstFetchReq(hash string, slowMillis int, calls, cancelled *int32,
+	hedge *HedgePolicy) *AsyncFetchReq {
+
+	return &AsyncFetchReq{
+		Hash: hash,
+		Fetcher: func(ctx context.Context) (interface{}, error) {
+			n := atomic.AddInt32(calls, 1)
+			wait := time.Millisecond
+			if n == 1 {
+				wait = time.Duration(slowMillis) * time.Millisecond
+			}
+			select {
+			case <-time.After(wait):
+				return n, nil
+			case <-ctx.Done():
+				atomic.AddInt32(cancelled, 1)
+				return nil, ctx.Err()
+			}
+		},
+		Hedge: hedge,
+	}
+}
+
+func Test_FetcherHedged(t *testing.T) {
+	var calls, cancelled int32
+	req := newTestSlowFirstFetchReq("Customer_1", 200, &calls, &cancelled,
+		&HedgePolicy{Delay: 5 * time.Millisecond})
+
+	// all the waiters share the hedged fetch
+	start := time.Now()
+	res, err := NewDataFetcherImpl(2).WaitForFetches(context.Background(), req, req)
+	if err != nil {
+		t.Errorf("unexpected error %s", err.Error())
+		return
+	}
+	if time.Since(start) > 100*time.Millisecond {
+		t.Errorf("should not wait for the slow call")
+		return
+	}
+	for _, d := range res {
+		if d.Err != nil || d.Result != int32(2) || d.Attempts != 2 {
+			t.Errorf("unexpected fetch data %+v", d)
+			return
+		}
+	}
+	if calls != 2 {
+		t.Errorf("calls, want 2, got %d", calls)
+		return
+	}
+	time.Sleep(5 * time.Millisecond)
+	if atomic.LoadInt32(&cancelled) != 1 {
+		t.Errorf("the slow call should be cancelled")
+	}
+}
+
+func Test_FetcherNotHedged(t *testing.T) {
+	var calls, cancelled int32
+	req := newTestSlowFirstFetchReq("Customer_1", 1, &calls, &cancelled,
+		&HedgePolicy{Delay: 20 * time.Millisecond})
+
+	res, _ := NewDataFetcherImpl(1).WaitForFetch(context.Background(), req)
+	if res.Err != nil || res.Result != int32(1) || res.Attempts != 1 {
+		t.Errorf("unexpected fetch data %+v", res)
+		return
+	}
+	if calls != 1 {
+		t.Errorf("calls, want 1, got %d", calls)
+	}
+}
+
+func Test_FetcherHedgedFromLatencies(t *testing.T) {
+	latencies := NewLatencyTracker(LatencyConf{MinSamples: 3})
+	for i := 0; i < 3; i++ {
+		latencies.Record("Customer", 2*time.Millisecond)
+	}
+
+	var calls, cancelled int32
+	req := newTestSlowFirstFetchReq("Customer_1", 200, &calls, &cancelled,
+		&HedgePolicy{Delay: time.Hour, Latencies: latencies})
+	res, _ := NewDataFetcherImpl(1).WaitForFetch(context.Background(), req)
+	if res.Err != nil || res.Result != int32(2) || res.Attempts != 2 {
+		t.Errorf("unexpected fetch data %+v", res)
+		return
+	}
+	if _, ok := latencies.Percentile("Customer", 1); !ok {
+		t.Errorf("want the latencies of the family")
+	}
+}
+
+func Test_LatencyTrackerPercentile(t *testing.T) {
+	latencies := NewLatencyTracker(LatencyConf{Samples: 10, MinSamples: 5})
+	for i := 1; i <= 4; i++ {
+		latencies.Record("Customer", time.Duration(i)*time.Millisecond)
+	}
+	if _, ok := latencies.Percentile("Customer", 0.5); ok {
+		t.Errorf("want not enough samples")
+		return
+	}
+
+	// only the last 10 samples are kept: 11ms to 20ms
+	for i := 5; i <= 20; i++ {
+		latencies.Record("Customer", time.Duration(i)*time.Millisecond)
+	}
+	for p, want := range map[float64]time.Duration{0: 11, 0.5: 15, 0.9: 19, 1: 20} {
+		got, ok := latencies.Percentile("Customer", p)
+		if !ok || got != want*time.Millisecond {
+			t.Errorf("percentile %v, want %v, got %v", p, want*time.Millisecond, got)
+		}
+	}
+	if _, ok := latencies.Percentile("Product", 0.5); ok {
+		t.Errorf("want no samples for another family")
+	}
+}
+
+func Test_FetcherHedgedLimiter(t *testing.T) {
+	var tracker concurrencyTracker
+	var calls int32
+	// the first call ignores the cancellation, and keeps running after
+	// the hedged one wins
+	fetcher := func(ctx context.Context) (interface{}, error) {
+		d := 10 * time.Millisecond
+		if atomic.AddInt32(&calls, 1) == 1 {
+			d = 50 * time.Millisecond
+		}
+		tracker.run(d)
+		return "ok", nil
+	}
+	df := NewDataFetcherImpl(1)
+	df.SetLimiter(NewFetchLimiter(FetchLimits{PerFamily: map[string]int{"Customer": 2}}))
+	hedge := &HedgePolicy{Delay: 5 * time.Millisecond}
+
+	for _, hash := range []string{"Customer_1", "Customer_2"} {
+		res, _ := df.WaitForFetch(context.Background(), &AsyncFetchReq{
+			Hash:    hash,
+			Fetcher: fetcher,
+			Hedge:   hedge,
+		})
+		if res.Err != nil {
+			t.Errorf("unexpected error %s", res.Err.Error())
+			return
+		}
+	}
+	time.Sleep(50 * time.Millisecond)
+	if tracker.Max() > 2 {
+		t.Errorf("concurrent calls, want at most 2, got %d", tracker.Max())
+	}
+}
@@ -0,0 +1,120 @@
+package datablocks
+
+import (
+	"context"
+	"sync/atomic"
+)
+
+// FetchLimits holds the configuration for a FetchLimiter. A limit <= 0
+// means no limit.
+type FetchLimits struct {
+	// MaxConcurrent is the maximum number of fetches running at the
+	// same time
+	MaxConcurrent int
+	// PerFamily has the maximum number of fetches running at the same
+	// time for each family of requests (see AsyncFetchReq.Family)
+	PerFamily map[string]int
+}
+
+// FetchLimiter limits the number of fetches running at the same time,
+// queueing the rest until a slot is free or their context is done. It is
+// usually shared by all the DataFetcherImpl of a process, to protect the
+// downstream services (see DataFetcherImpl.SetLimiter).
+type FetchLimiter struct {
+	global   chan struct{}
+	families map[string]chan struct{}
+}
+
+// NewFetchLimiter creates a FetchLimiter
+func NewFetchLimiter(limits FetchLimits) *FetchLimiter {
+	l := &FetchLimiter{
+		global:   newSemaphore(limits.MaxConcurrent),
+		families: make(map[string]chan struct{}, len(limits.PerFamily)),
+	}
+	for family, limit := range limits.PerFamily {
+		if sem := newSemaphore(limit); sem != nil {
+			l.families[family] = sem
+		}
+	}
+	return l
+}
+
+// acquire waits for a free slot for a fetch of the family, and returns
+// the function to release it. A nil FetchLimiter does not limit anything.
+func (l *FetchLimiter) acquire(ctx context.Context, family string) (func(), error) {
+	if l == nil {
+		return func() {}, nil
+	}
+
+	// we wait for the family slot first, so we do not hold a global slot
+	// while the family is full
+	familySem := l.families[family]
+	if err := acquireSemaphore(ctx, familySem); err != nil {
+		return nil, err
+	}
+	if err := acquireSemaphore(ctx, l.global); err != nil {
+		releaseSemaphore(familySem)
+		return nil, err
+	}
+	return func() {
+		releaseSemaphore(l.global)
+		releaseSemaphore(familySem)
+	}, nil
+}
+
+// newSemaphore returns a semaphore with limit slots, or nil if
+// limit <= 0 (no limit)
+func newSemaphore(limit int) chan struct{} {
+	if limit <= 0 {
+		return nil
+	}
+	return make(chan struct{}, limit)
+}
+
+// acquireSemaphore waits for a free slot in sem, unless ctx is done
+// first. A nil sem has no limit.
+func acquireSemaphore(ctx context.Context, sem chan struct{}) error {
+	if sem == nil {
+		return nil
+	}
+	select {
+	case sem <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func releaseSemaphore(sem chan struct{}) {
+	if sem != nil {
+		<-sem
+	}
+}
+
+// nodeSlot is a slot of a semaphore held by a node being built (see
+// SetMaxParallelNodes), that is released once the node and the builder
+// goroutine, that can outlive the node timeout, are done with it
+type nodeSlot struct {
+	sem  chan struct{}
+	refs int32
+}
+
+// acquireNodeSlot waits for a free slot in sem (see acquireSemaphore),
+// that is held until release is called
+func acquireNodeSlot(ctx context.Context, sem chan struct{}) (*nodeSlot, error) {
+	if err := acquireSemaphore(ctx, sem); err != nil {
+		return nil, err
+	}
+	return &nodeSlot{sem: sem, refs: 1}, nil
+}
+
+// hold keeps the slot until an extra call to release
+func (s *nodeSlot) hold() {
+	atomic.AddInt32(&s.refs, 1)
+}
+
+func (s *nodeSlot) release() {
+	if atomic.AddInt32(&s.refs, -1) == 0 {
+		releaseSemaphore(s.sem)
+	}
+}
@@ -0,0 +1,181 @@
+package datablocks
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// concurrencyTracker records the maximum number of calls running at
+// the same time
+type concurrencyTracker struct {
+	mut     sync.Mutex
+	running int
+	max     int
+}
+
+func (c *concurrencyTracker) run(d time.Duration) {
+	c.mut.Lock()
+	c.running += 1
+	if c.running > c.max {
+		c.max = c.running
+	}
+	c.mut.Unlock()
+
+	time.Sleep(d)
+
+	c.mut.Lock()
+	c.running -= 1
+	c.mut.Unlock()
+}
+
+func (c *concurrencyTracker) Max() int {
+	c.mut.Lock()
+	defer c.mut.Unlock()
+	return c.max
+}
+
+func Test_FetchLimiter(t *testing.T) {
+	limiter := NewFetchLimiter(FetchLimits{
+		MaxConcurrent: 3,
+		PerFamily:     map[string]int{"Customer": 1},
+	})
+	var all, customers concurrencyTracker
+
+	var reqs []*AsyncFetchReq
+	for i := 0; i < 8; i++ {
+		family := "Product"
+		if i%2 == 0 {
+			family = "Customer"
+		}
+		reqs = append(reqs, &AsyncFetchReq{
+			Hash: fmt.Sprintf("%s_%d", family, i),
+			Fetcher: func(ctx context.Context) (interface{}, error) {
+				if family == "Customer" {
+					customers.run(0)
+				}
+				all.run(5 * time.Millisecond)
+				return "ok", nil
+			},
+		})
+	}
+
+	df := NewDataFetcherImpl(len(reqs))
+	df.SetLimiter(limiter)
+	res, err := df.WaitForFetches(context.Background(), reqs...)
+	if err != nil {
+		t.Errorf("unexpected error %s", err.Error())
+		return
+	}
+	for _, d := range res {
+		if d.Err != nil {
+			t.Errorf("unexpected fetch error %s", d.Err.Error())
+			return
+		}
+	}
+	if all.Max() > 3 || customers.Max() > 1 {
+		t.Errorf("concurrent fetches, want at most 3 and 1 customer, got %d and %d",
+			all.Max(), customers.Max())
+	}
+}
+
+func Test_FetchLimiterCancelled(t *testing.T) {
+	limiter := NewFetchLimiter(FetchLimits{MaxConcurrent: 1})
+	release, _ := limiter.acquire(context.Background(), "Customer")
+	defer release()
+
+	df := NewDataFetcherImpl(1)
+	df.SetLimiter(limiter)
+	var calls int32
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	recv, _ := df.Fetch(ctx, newTestCountingFetchReq("Customer_1", 1, &calls, "ok", nil))
+
+	select {
+	case res := <-recv:
+		if !errors.Is(res.Err, context.DeadlineExceeded) || res.Attempts != 0 {
+			t.Errorf("unexpected fetch data %+v", res)
+			return
+		}
+	case <-time.After(time.Second):
+		t.Errorf("time expired")
+		return
+	}
+	if atomic.LoadInt32(&calls) != 0 {
+		t.Errorf("the fetcher should not be called")
+	}
+}
+
+func Test_BuilderMaxParallelNodes(t *testing.T) {
+	var tracker concurrencyTracker
+	builder := func(ctx context.Context, df DataFetcher) (interface{}, error) {
+		tracker.run(10 * time.Millisecond)
+		return "ok", nil
+	}
+	conf := BuilderConfig{
+		StorageKey: "test_response",
+		// the node timeout does not count the time waiting for a turn
+		NodeTimeout:      25 * time.Millisecond,
+		MaxParallelNodes: 2,
+	}
+	for i := 0; i < 6; i++ {
+		conf.Nodes = append(conf.Nodes, NodeConf{
+			Key:      fmt.Sprintf("n%d", i),
+			Required: true,
+			Builder:  builder,
+		})
+	}
+
+	rb, err := NewResponseBuilderWithConfig(NewNopKeyValStorage(), conf)
+	if err != nil {
+		t.Errorf("unexpected error %s", err.Error())
+		return
+	}
+	res, err := rb.Build(context.Background())
+	if err != nil {
+		t.Errorf("unexpected error %s", err.Error())
+		return
+	}
+	if len(res) != 6 {
+		t.Errorf("output len, want 6, got %d", len(res))
+	}
+	if tracker.Max() != 2 {
+		t.Errorf("parallel nodes, want 2, got %d", tracker.Max())
+	}
+}
+
+func Test_BuilderMaxParallelNodesTimeout(t *testing.T) {
+	var tracker concurrencyTracker
+	// the builder ignores the context, so it keeps running after the
+	// node timeout
+	builder := func(ctx context.Context, df DataFetcher) (interface{}, error) {
+		tracker.run(30 * time.Millisecond)
+		return "ok", nil
+	}
+	conf := BuilderConfig{
+		StorageKey:       "test_response",
+		NodeTimeout:      5 * time.Millisecond,
+		MaxParallelNodes: 1,
+	}
+	for i := 0; i < 3; i++ {
+		conf.Nodes = append(conf.Nodes, NodeConf{
+			Key:     fmt.Sprintf("n%d", i),
+			Builder: builder,
+		})
+	}
+
+	rb, err := NewResponseBuilderWithConfig(NewNopKeyValStorage(), conf)
+	if err != nil {
+		t.Errorf("unexpected error %s", err.Error())
+		return
+	}
+	rb.Build(context.Background())
+	time.Sleep(120 * time.Millisecond)
+	if tracker.Max() != 1 {
+		t.Errorf("parallel builders, want 1, got %d", tracker.Max())
+	}
+}
@@ -2,6 +2,9 @@ package datablocks
 
 import (
 	"context"
+	"fmt"
+	"strings"
+	"time"
 )
 
 // NodeBuilderFn defines the interface required for a
@@ -15,4 +18,126 @@ type NodeConf struct {
 	Required bool
 
 	Builder NodeBuilderFn
+
+	// Timeout overrides the ResponseBuilder node timeout for this node,
+	// when 0 the ResponseBuilder one is used, and a negative value
+	// disables it. It is measured from the moment the node starts to be
+	// built (after its dependencies are ready).
+	Timeout time.Duration
+
+	// StaleAllowed makes a dynamic node be saved in the storage like the
+	// static ones, so the value from a previous build can be served when
+	// the fresh one is not ready in time (or fails). The fresh value is
+	// saved back when it is built. MaxStaleness limits the age of the
+	// value that can be served (0 means no limit).
+	StaleAllowed bool
+	MaxStaleness time.Duration
+
+	// Fallback is the value of an optional node that fails, times out,
+	// or is not built yet when Build returns (and has no stale value to
+	// serve), or the value returned by FallbackFn when set. It is ignored
+	// for required nodes, and never saved in the storage. The dependents
+	// of the node fail anyway.
+	Fallback   interface{}
+	FallbackFn func() interface{}
+
+	// DependsOn has the keys of the nodes whose results are needed to
+	// build this node. The node is only built once all of them are built
+	// successfully, and their results are available to Builder with
+	// DependencyResult. If one of them fails, this node fails too.
+	DependsOn []string
+
+	// NewResult returns a value of the type returned by Builder (i.e:
+	// `func() interface{} { return &Customer{} }`), so a static node
+	// restored from the storage has the same type than a freshly built
+	// one. When nil, the node is decoded into an empty interface (that
+	// is a map[string]interface{} for a JSON object).
+	NewResult func() interface{}
+
+	// Codec is used to save and restore a static node from the storage,
+	// when nil the ResponseBuilder codec is used.
+	Codec Codec
+}
+
+// NodeTimeoutError is the error of a node that did not finish before
+// its timeout.
+type NodeTimeoutError struct {
+	Key     string
+	Timeout time.Duration
+	// Err is the error returned by the node builder, if it returned
+	// before we stopped waiting for it
+	Err error
+}
+
+func (e *NodeTimeoutError) Error() string {
+	return fmt.Sprintf("node %s: timed out after %v", e.Key, e.Timeout)
+}
+
+func (e *NodeTimeoutError) Unwrap() error {
+	if e.Err != nil {
+		return e.Err
+	}
+	return context.DeadlineExceeded
+}
+
+// DependencyError is the error of a node that could not be built
+// because one of its dependencies failed.
+type DependencyError struct {
+	Key        string
+	Dependency string
+	Err        error
+}
+
+func (e *DependencyError) Error() string {
+	return fmt.Sprintf("node %s: dependency %s failed: %s", e.Key, e.Dependency,
+		e.Err.Error())
+}
+
+func (e *DependencyError) Unwrap() error {
+	return e.Err
+}
+
+// DependencyCycleError is returned when creating a ResponseBuilder with
+// nodes that depend on each other.
+type DependencyCycleError struct {
+	// Cycle has the keys of the nodes in the cycle, the first one
+	// depends on the second one, and so on until the last one, that
+	// depends on the first one.
+	Cycle []string
+}
+
+func (e *DependencyCycleError) Error() string {
+	return fmt.Sprintf("dependency cycle: %s -> %s", strings.Join(e.Cycle, " -> "),
+		e.Cycle[0])
+}
+
+// hasFallback tells if the node has a fallback value
+func (n *NodeConf) hasFallback() bool {
+	return !n.Required && (n.Fallback != nil || n.FallbackFn != nil)
+}
+
+// fallback returns the fallback value of the node, a panic in
+// FallbackFn is returned as a *PanicError
+func (n *NodeConf) fallback() (interface{}, error) {
+	if n.FallbackFn != nil {
+		return callFallback(n.Key, n.FallbackFn)
+	}
+	return n.Fallback, nil
+}
+
+// nodeDepsKey is the context key for the results of the dependencies
+type nodeDepsKey struct{}
+
+// withDependencyResults returns a context holding the results of the
+// dependencies of a node.
+func withDependencyResults(ctx context.Context, deps map[string]interface{}) context.Context {
+	return context.WithValue(ctx, nodeDepsKey{}, deps)
+}
+
+// DependencyResult returns the result of one of the dependencies (see
+// NodeConf.DependsOn) from the context passed to a NodeBuilderFn.
+func DependencyResult(ctx context.Context, key string) (interface{}, bool) {
+	deps, _ := ctx.Value(nodeDepsKey{}).(map[string]interface{})
+	res, ok := deps[key]
+	return res, ok
 }
@@ -0,0 +1,72 @@
+package datablocks
+
+import (
+	"context"
+	"fmt"
+	"runtime/debug"
+)
+
+// PanicError is the error of a node builder, or a data fetcher, that
+// panicked. The panic is recovered and handled as any other failure, so
+// a bug in a node cannot take down the whole process.
+type PanicError struct {
+	// Key is the node key, and Hash the fetch hash (only one of them
+	// is set)
+	Key  string
+	Hash string
+
+	// Value is the value passed to panic, and Stack the stack trace
+	// of the goroutine that panicked
+	Value interface{}
+	Stack []byte
+}
+
+func (e *PanicError) Error() string {
+	if len(e.Hash) > 0 {
+		return fmt.Sprintf("fetch %s: panic: %v", e.Hash, e.Value)
+	}
+	return fmt.Sprintf("node %s: panic: %v", e.Key, e.Value)
+}
+
+// Unwrap returns the panic value when it is an error
+func (e *PanicError) Unwrap() error {
+	err, _ := e.Value.(error)
+	return err
+}
+
+// callNodeBuilder calls a node builder, converting a panic into
+// a *PanicError
+func callNodeBuilder(ctx context.Context, key string, builder NodeBuilderFn,
+	df DataFetcher) (res interface{}, err error) {
+
+	defer func() {
+		if v := recover(); v != nil {
+			res, err = nil, &PanicError{Key: key, Value: v, Stack: debug.Stack()}
+		}
+	}()
+	return builder(ctx, df)
+}
+
+// callFallback calls the fallback function of a node, converting a
+// panic into a *PanicError
+func callFallback(key string, fn func() interface{}) (res interface{}, err error) {
+	defer func() {
+		if v := recover(); v != nil {
+			res, err = nil, &PanicError{Key: key, Value: v, Stack: debug.Stack()}
+		}
+	}()
+	return fn(), nil
+}
+
+// callFetcher calls a data fetcher, converting a panic into
+// a *PanicError
+func callFetcher(ctx context.Context, hash string,
+	fetcher DataFetcherFn) (res interface{}, err error) {
+
+	defer func() {
+		if v := recover(); v != nil {
+			res, err = nil, &PanicError{Hash: hash, Value: v, Stack: debug.Stack()}
+		}
+	}()
+	return fetcher(ctx)
+}
@@ -0,0 +1,90 @@
+package datablocks
+
+import (
+	"context"
+	"errors"
+	"io"
+	"testing"
+)
+
+func Test_NodeBuilderPanics(t *testing.T) {
+	panicking := func(ctx context.Context, df DataFetcher) (interface{}, error) {
+		panic("node bug")
+	}
+	nodesConf := []NodeConf{
+		NodeConf{
+			Key:      "ok",
+			Required: true,
+			Builder:  newTestValueNodeBuilder(1, "ok"),
+		},
+		NodeConf{
+			Key:      "with_timeout",
+			Required: false,
+			Builder:  panicking,
+		},
+		NodeConf{
+			Key:      "without_timeout",
+			Required: false,
+			Timeout:  -1,
+			Builder:  panicking,
+		},
+	}
+	rb, err := NewResponseBuilder("test_response", NewNopKeyValStorage(),
+		NewDataFetcherImpl(len(nodesConf)), nodesConf, 100)
+	if err != nil {
+		t.Errorf("unexpected error %s", err.Error())
+		return
+	}
+	if buildAndWait(t, rb) {
+		t.Errorf("want the panicking nodes to fail")
+		return
+	}
+	if output := rb.Result(); output["ok"] != "ok" || len(output) != 1 {
+		t.Errorf("unexpected output %#v", output)
+		return
+	}
+
+	report := rb.Report()
+	for _, key := range []string{"with_timeout", "without_timeout"} {
+		n, _ := report.Node(key)
+		var panicErr *PanicError
+		if !errors.As(n.Err, &panicErr) {
+			t.Errorf("%s, want a PanicError, got %v", key, n.Err)
+			continue
+		}
+		if panicErr.Key != key || panicErr.Value != "node bug" || len(panicErr.Stack) == 0 {
+			t.Errorf("%s, unexpected panic error %#v", key, panicErr)
+		}
+		if n.Status != NodeFailed {
+			t.Errorf("%s, status, want failed, got %s", key, n.Status)
+		}
+	}
+}
+
+func Test_FetcherPanics(t *testing.T) {
+	df := NewDataFetcherImpl(2)
+	req := &AsyncFetchReq{
+		Hash: "Panicking_1",
+		Fetcher: func(ctx context.Context) (interface{}, error) {
+			panic(io.ErrUnexpectedEOF)
+		},
+	}
+
+	ctx := context.Background()
+	for i := 0; i < 2; i++ {
+		res, err := df.WaitForFetch(ctx, req)
+		if err != nil {
+			t.Errorf("unexpected error %s", err.Error())
+			return
+		}
+		var panicErr *PanicError
+		if !errors.As(res.Err, &panicErr) || panicErr.Hash != "Panicking_1" {
+			t.Errorf("want a PanicError for the fetch, got %v", res.Err)
+			return
+		}
+		if !errors.Is(res.Err, io.ErrUnexpectedEOF) {
+			t.Errorf("PanicError should unwrap the panic error value")
+			return
+		}
+	}
+}
@@ -0,0 +1,156 @@
+package datablocks
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+// NodeStatus is the state of the build of a node
+type NodeStatus int
+
+const (
+	// NodePending is a node that has not finished to build
+	NodePending NodeStatus = iota
+	NodeOK
+	NodeFailed
+	NodeTimedOut
+	NodeCancelled
+)
+
+func (s NodeStatus) String() string {
+	switch s {
+	case NodePending:
+		return "pending"
+	case NodeOK:
+		return "ok"
+	case NodeFailed:
+		return "failed"
+	case NodeTimedOut:
+		return "timed_out"
+	case NodeCancelled:
+		return "cancelled"
+	}
+	return "unknown"
+}
+
+// NodeSource tells where the value of a node comes from
+type NodeSource int
+
+const (
+	// SourceNone is a node without a value
+	SourceNone NodeSource = iota
+	// SourceBuilt is a node built by its node builder
+	SourceBuilt
+	// SourceStorage is a static node restored from the storage
+	SourceStorage
+	// SourceStale is a node that allows stale values, served with the
+	// value from a previous build
+	SourceStale
+	// SourceShared is a static node built by another builder with the
+	// same storage key (see BuildCoordinator)
+	SourceShared
+	// SourceFallback is an optional node that failed, served with its
+	// fallback value (see NodeConf.Fallback)
+	SourceFallback
+)
+
+func (s NodeSource) String() string {
+	switch s {
+	case SourceNone:
+		return "none"
+	case SourceBuilt:
+		return "built"
+	case SourceStorage:
+		return "storage"
+	case SourceStale:
+		return "stale"
+	case SourceShared:
+		return "shared"
+	case SourceFallback:
+		return "fallback"
+	}
+	return "unknown"
+}
+
+// NodeReport has the outcome of the build of a node
+type NodeReport struct {
+	Key      string
+	Required bool
+	Status   NodeStatus
+	Err      error
+	Source   NodeSource
+
+	// Start and End are the times the node started and finished to
+	// build (or when it was restored from the storage)
+	Start time.Time
+	End   time.Time
+	// Attempts is the number of times the node builder was called
+	// (0 for the nodes restored from the storage or shared)
+	Attempts int
+}
+
+// Duration returns how long it took to build the node, 0 if it
+// has not finished
+func (n *NodeReport) Duration() time.Duration {
+	if n.Start.IsZero() || n.End.IsZero() {
+		return 0
+	}
+	return n.End.Sub(n.Start)
+}
+
+// BuildReport has the outcome of a build, to be logged or used for
+// metrics. It is a snapshot of the moment it was requested, so it can
+// be incomplete if the build has not finished.
+type BuildReport struct {
+	StorageKey string
+	Start      time.Time
+
+	// RequiredReadyAfter is the time it took to have all the required
+	// nodes built, only valid if RequiredReady is true
+	RequiredReady      bool
+	RequiredReadyAfter time.Duration
+	// FullReadyAfter is the time it took to finish the build of all the
+	// nodes (successfully or not), only valid if FullReady is true
+	FullReady      bool
+	FullReadyAfter time.Duration
+
+	// Nodes are in the same order they were configured
+	Nodes []NodeReport
+}
+
+// Node returns the report of a node
+func (r *BuildReport) Node(key string) (NodeReport, bool) {
+	for _, n := range r.Nodes {
+		if n.Key == key {
+			return n, true
+		}
+	}
+	return NodeReport{}, false
+}
+
+// Failed returns the reports of the nodes that failed, timed out or
+// were cancelled
+func (r *BuildReport) Failed() []NodeReport {
+	var failed []NodeReport
+	for _, n := range r.Nodes {
+		if n.Err != nil {
+			failed = append(failed, n)
+		}
+	}
+	return failed
+}
+
+// nodeStatus returns the status for a finished node with its error
+func nodeStatus(err error) NodeStatus {
+	var timeoutErr *NodeTimeoutError
+	switch {
+	case err == nil:
+		return NodeOK
+	case errors.As(err, &timeoutErr):
+		return NodeTimedOut
+	case errors.Is(err, context.Canceled):
+		return NodeCancelled
+	}
+	return NodeFailed
+}
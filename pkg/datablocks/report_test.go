@@ -0,0 +1,87 @@
+package datablocks
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func Test_BuildReport(t *testing.T) {
+	nodesConf := []NodeConf{
+		NodeConf{
+			Key:      "a",
+			Required: true,
+			Builder:  newTestValueNodeBuilder(5, "a"),
+		},
+		NodeConf{
+			Key:      "b",
+			Required: false,
+			Builder:  newTestDelayedNodeBuilder(1, fmt.Errorf("failed")),
+		},
+		NodeConf{
+			Key:      "c",
+			Required: false,
+			Timeout:  5 * time.Millisecond,
+			Builder:  newTestValueNodeBuilder(50, "c"),
+		},
+		NodeConf{
+			Key:       "d",
+			Required:  false,
+			DependsOn: []string{"b"},
+			Builder:   newTestValueNodeBuilder(1, "d"),
+		},
+	}
+	rb, err := NewResponseBuilder("test_response", NewNopKeyValStorage(),
+		NewDataFetcherImpl(len(nodesConf)), nodesConf, 100)
+	if err != nil {
+		t.Errorf("unexpected error %s", err.Error())
+		return
+	}
+
+	report := rb.Report()
+	if !report.Start.IsZero() || report.RequiredReady || len(report.Nodes) != 4 {
+		t.Errorf("unexpected report before the build %+v", report)
+		return
+	}
+
+	fullReady := make(chan bool, 1)
+	rb.BuildAsync(context.Background(), nil, fullReady)
+	<-fullReady
+
+	report = rb.Report()
+	if !report.RequiredReady || !report.FullReady ||
+		report.RequiredReadyAfter <= 0 || report.FullReadyAfter < report.RequiredReadyAfter {
+		t.Errorf("unexpected ready times %+v", report)
+		return
+	}
+
+	want := []struct {
+		status   NodeStatus
+		source   NodeSource
+		attempts int
+	}{
+		{NodeOK, SourceBuilt, 1},
+		{NodeFailed, SourceNone, 1},
+		{NodeTimedOut, SourceNone, 1},
+		{NodeFailed, SourceNone, 0},
+	}
+	for idx, w := range want {
+		n := report.Nodes[idx]
+		if n.Status != w.status || n.Source != w.source || n.Attempts != w.attempts {
+			t.Errorf("%s, want %s / %s / %d, got %s / %s / %d", n.Key, w.status, w.source,
+				w.attempts, n.Status, n.Source, n.Attempts)
+		}
+		if (n.Err == nil) != (w.status == NodeOK) {
+			t.Errorf("%s, unexpected error %v", n.Key, n.Err)
+		}
+	}
+
+	a, _ := report.Node("a")
+	if a.Duration() < 5*time.Millisecond {
+		t.Errorf("a duration, want at least 5ms, got %v", a.Duration())
+	}
+	if failed := report.Failed(); len(failed) != 3 {
+		t.Errorf("failed nodes, want 3, got %d", len(failed))
+	}
+}
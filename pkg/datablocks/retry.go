@@ -0,0 +1,127 @@
+package datablocks
+
+import (
+	"context"
+	"errors"
+	"math"
+	"math/rand"
+	"time"
+)
+
+const (
+	DefaultRetryMultiplier float64 = 2
+)
+
+// RetryPolicy defines how a failed fetch is retried (see AsyncFetchReq).
+//
+// The retries are done inside the shared in-flight fetch, so all the
+// callers waiting for the same hash get the final result, and they
+// stop when the context of the fetch is done: a retry is not attempted
+// if its backoff would end after the context deadline.
+type RetryPolicy struct {
+	// MaxAttempts is the total number of calls to the fetcher, including
+	// the first one (a value <= 1 disables the retries)
+	MaxAttempts int
+
+	// InitialBackoff is the wait before the first retry, that is
+	// multiplied by Multiplier (DefaultRetryMultiplier if <= 1) for
+	// each following retry, up to MaxBackoff (0 means no limit)
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+	Multiplier     float64
+
+	// Jitter is the fraction of each backoff that is randomized (between
+	// 0 and 1), so the retries of different fetches are spread in time
+	Jitter float64
+
+	// Retryable tells if a fetch that failed with err should be retried.
+	// When nil, all the errors are retried except the context ones.
+	Retryable func(err error) bool
+}
+
+// backoff returns the wait before a retry (the first retry is 1)
+func (p *RetryPolicy) backoff(retry int) time.Duration {
+	multiplier := p.Multiplier
+	if multiplier <= 1 {
+		multiplier = DefaultRetryMultiplier
+	}
+	d := float64(p.InitialBackoff) * math.Pow(multiplier, float64(retry-1))
+	if p.MaxBackoff > 0 && d > float64(p.MaxBackoff) {
+		d = float64(p.MaxBackoff)
+	}
+	if p.Jitter > 0 {
+		jitter := math.Min(p.Jitter, 1)
+		d -= d * jitter * rand.Float64()
+	}
+	return time.Duration(d)
+}
+
+// retryable tells if a failed fetch should be retried
+func (p *RetryPolicy) retryable(err error) bool {
+	if p.Retryable != nil {
+		return p.Retryable(err)
+	}
+	return !errors.Is(err, context.Canceled) && !errors.Is(err, context.DeadlineExceeded)
+}
+
+// fetchWithRetries calls the fetcher until it succeeds or the retry
+// policy (that can be nil) is exhausted, returning the number of
+// attempts. Each attempt waits for a free slot in the limiter (that
+// can be nil too, and is not used for the items of a Batcher), and is
+// hedged when the request has a hedge policy.
+// The attempts go through the circuit breaker of the family of the
+// request (when breakers is not nil), and stop once it is open.
+func fetchWithRetries(ctx context.Context, req *AsyncFetchReq,
+	limiter *FetchLimiter, breakers *CircuitBreakers) (interface{}, int, error) {
+
+	if req.batched {
+		// the Batcher waits for a slot for each batch instead
+		limiter = nil
+	}
+	attempts := 0
+	p := req.Retry
+	breaker := breakers.Breaker(req.family())
+	for {
+		gen, err := breaker.before()
+		if err != nil {
+			return nil, attempts, err
+		}
+		var res interface{}
+		var calls int
+		if req.Hedge != nil {
+			// each call of the hedged fetch holds its own slot
+			res, calls, err = req.Hedge.fetch(ctx, req, limiter)
+		} else {
+			var release func()
+			if release, err = limiter.acquire(ctx, req.family()); err == nil {
+				calls = 1
+				res, err = callFetcher(ctx, req.Hash, req.Fetcher)
+				release()
+			}
+		}
+		if calls == 0 {
+			// we did not get a slot in the limiter
+			breaker.skip(gen)
+			return nil, attempts, err
+		}
+		attempts += calls
+		breaker.after(gen, err)
+		if p == nil || err == nil || attempts >= p.MaxAttempts || !p.retryable(err) {
+			return res, attempts, err
+		}
+
+		wait := p.backoff(attempts)
+		if deadline, ok := ctx.Deadline(); ok && time.Now().Add(wait).After(deadline) {
+			// we would not have time to retry
+			return res, attempts, err
+		}
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return res, attempts, err
+		}
+	}
+}
@@ -0,0 +1,130 @@
+package datablocks
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// newTestFlakyFetchReq returns a request that fails the first
+// failures calls, and counts the calls in calls
+func newTestFlakyFetchReq(hash string, failures int32, calls *int32,
+	retry *RetryPolicy) *AsyncFetchReq {
+
+	return &AsyncFetchReq{
+		Hash: hash,
+		Fetcher: func(ctx context.Context) (interface{}, error) {
+			n := atomic.AddInt32(calls, 1)
+			time.Sleep(time.Millisecond)
+			if n <= failures {
+				return nil, fmt.Errorf("failure %d", n)
+			}
+			return "done", nil
+		},
+		Retry: retry,
+	}
+}
+
+func Test_RetryPolicyBackoff(t *testing.T) {
+	p := &RetryPolicy{
+		InitialBackoff: 10 * time.Millisecond,
+		MaxBackoff:     50 * time.Millisecond,
+		Multiplier:     3,
+	}
+	for retry, want := range []time.Duration{10, 30, 50, 50} {
+		if got := p.backoff(retry + 1); got != want*time.Millisecond {
+			t.Errorf("retry %d, want %v, got %v", retry+1, want*time.Millisecond, got)
+		}
+	}
+
+	p.Jitter = 0.5
+	for i := 0; i < 20; i++ {
+		got := p.backoff(2)
+		if got < 15*time.Millisecond || got > 30*time.Millisecond {
+			t.Errorf("backoff with jitter out of range %v", got)
+			return
+		}
+	}
+}
+
+func Test_FetcherRetries(t *testing.T) {
+	var calls int32
+	req := newTestFlakyFetchReq("Flaky_1", 2, &calls, &RetryPolicy{
+		MaxAttempts:    3,
+		InitialBackoff: time.Millisecond,
+	})
+
+	// all the waiters share the retries of the same fetch
+	df := NewDataFetcherImpl(2)
+	ctx := context.Background()
+	res, err := df.WaitForFetches(ctx, req, req)
+	if err != nil {
+		t.Errorf("unexpected error %s", err.Error())
+		return
+	}
+	for _, d := range res {
+		if d.Err != nil || d.Result != "done" || d.Attempts != 3 {
+			t.Errorf("unexpected fetch data %+v", d)
+			return
+		}
+	}
+	if calls != 3 {
+		t.Errorf("calls, want 3, got %d", calls)
+	}
+}
+
+func Test_FetcherRetriesExhausted(t *testing.T) {
+	var calls int32
+	errNotFound := errors.New("not found")
+	req := &AsyncFetchReq{
+		Hash: "NotFound_1",
+		Fetcher: func(ctx context.Context) (interface{}, error) {
+			atomic.AddInt32(&calls, 1)
+			return nil, errNotFound
+		},
+		Retry: &RetryPolicy{
+			MaxAttempts: 5,
+			Retryable:   func(err error) bool { return err != errNotFound },
+		},
+	}
+	res, _ := NewDataFetcherImpl(1).WaitForFetch(context.Background(), req)
+	if res.Err != errNotFound || res.Attempts != 1 || calls != 1 {
+		t.Errorf("non retryable error, unexpected fetch data %+v", res)
+		return
+	}
+
+	calls = 0
+	req = newTestFlakyFetchReq("Flaky_2", 10, &calls, &RetryPolicy{MaxAttempts: 2})
+	res, _ = NewDataFetcherImpl(1).WaitForFetch(context.Background(), req)
+	if res.Err == nil || res.Attempts != 2 || calls != 2 {
+		t.Errorf("max attempts, unexpected fetch data %+v", res)
+	}
+}
+
+func Test_FetcherRetriesWithinDeadline(t *testing.T) {
+	var calls int32
+	req := newTestFlakyFetchReq("Flaky_3", 10, &calls, &RetryPolicy{
+		MaxAttempts:    10,
+		InitialBackoff: 10 * time.Millisecond,
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 25*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	res, err := NewDataFetcherImpl(1).WaitForFetch(ctx, req)
+	if err != nil {
+		t.Errorf("unexpected error %s", err.Error())
+		return
+	}
+	// 1ms + 10ms + 1ms, and the next 20ms backoff would not fit
+	if res.Err == nil || res.Attempts != 2 {
+		t.Errorf("unexpected fetch data %+v", res)
+		return
+	}
+	if time.Since(start) > 25*time.Millisecond {
+		t.Errorf("should not wait beyond the deadline")
+	}
+}
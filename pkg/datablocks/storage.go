@@ -1,9 +1,11 @@
 package datablocks
 
 import (
+	"bytes"
 	"context"
-	"fmt"
+	"errors"
 	"sync"
+	"time"
 )
 
 type KeyValStorage interface {
@@ -13,21 +15,48 @@ type KeyValStorage interface {
 	Set(ctx context.Context, key string, val []byte) error
 }
 
-type RedisKeyValStorage struct {
+// TTLKeyValStorage is implemented by the storages that can expire
+// their entries. A ttl <= 0 means the entry does not expire.
+//
+// Callers should discover it with a type assertion on a KeyValStorage
+// and fallback to Set when it is not available.
+type TTLKeyValStorage interface {
+	KeyValStorage
+	SetWithTTL(ctx context.Context, key string, val []byte, ttl time.Duration) error
 }
 
-func NewRedisKeyValStorage() *RedisKeyValStorage {
-	return &RedisKeyValStorage{}
+// LockKeyValStorage is implemented by the storages that can hold locks
+// (see BuilderConfig.BuildLock).
+type LockKeyValStorage interface {
+	KeyValStorage
+	// SetNX sets the key with an expiration only if it does not exist,
+	// returning true if it was set
+	SetNX(ctx context.Context, key string, val []byte, ttl time.Duration) (bool, error)
+	// DelIfEqual deletes the key only if it holds val (so a lock is only
+	// released by its owner), returning true if it was deleted
+	DelIfEqual(ctx context.Context, key string, val []byte) (bool, error)
 }
 
-func (s *RedisKeyValStorage) Get(ctx context.Context, key string) ([]byte, error) {
-	// TODO
-	return nil, fmt.Errorf("not implemented")
+// ErrLocksNotSupported is returned by the storages that wrap another one
+// (like TieredStorage) when the wrapped storage does not implement
+// LockKeyValStorage
+var ErrLocksNotSupported = errors.New("storage does not support locks")
+
+// lockForwarder is implemented by the storages that wrap another one, and
+// implement LockKeyValStorage only when the wrapped storage does
+type lockForwarder interface {
+	supportsLocks() bool
 }
 
-func (s *RedisKeyValStorage) Set(ctx context.Context, key string, val []byte) error {
-	// TODO
-	return fmt.Errorf("not implemented")
+// supportsLocks tells if the storage can hold locks
+func supportsLocks(storage KeyValStorage) bool {
+	if _, ok := storage.(LockKeyValStorage); !ok {
+		return false
+	}
+	if fwd, ok := storage.(lockForwarder); ok {
+		return fwd.supportsLocks()
+	}
+	return true
 }
 
 type NopKeyValStorage struct {
@@ -47,26 +76,149 @@ func (s *NopKeyValStorage) Set(ctx context.Context, key string, val []byte) erro
 	return nil
 }
 
+func (s *NopKeyValStorage) SetWithTTL(ctx context.Context, key string, val []byte,
+	ttl time.Duration) error {
+	// NOP
+	return nil
+}
+
+// DefaultInMemReapInterval is the reap interval used by
+// NewInMemKeyValStorageWithReaper when it is not positive
+const DefaultInMemReapInterval time.Duration = time.Minute
+
+// InMemStorage is a KeyValStorage that keeps the values in memory. Its
+// zero value is ready to use.
 type InMemStorage struct {
-	storage sync.Map
+	mut     sync.RWMutex
+	storage map[string]*inMemEntry // created on the first write
+
+	stopReaper chan struct{}
+	stopOnce   sync.Once
+}
+
+// inMemEntry is the value kept in InMemStorage, expiresAt is zero
+// for the entries that do not expire.
+type inMemEntry struct {
+	val       []byte
+	expiresAt time.Time
+}
+
+func (e *inMemEntry) expired(now time.Time) bool {
+	return !e.expiresAt.IsZero() && !now.Before(e.expiresAt)
 }
 
 func NewInMemKeyValStorage() *InMemStorage {
-	return &InMemStorage{}
+	return &InMemStorage{
+		storage: make(map[string]*inMemEntry),
+	}
+}
+
+// NewInMemKeyValStorageWithReaper creates an InMemStorage that removes
+// the expired entries every reapInterval (DefaultInMemReapInterval if
+// <= 0) in a background goroutine, until Close is called.
+//
+// Without the reaper, expired entries are never returned by Get, but
+// they are kept in memory until the key is set again.
+func NewInMemKeyValStorageWithReaper(reapInterval time.Duration) *InMemStorage {
+	if reapInterval <= 0 {
+		reapInterval = DefaultInMemReapInterval
+	}
+	s := NewInMemKeyValStorage()
+	s.stopReaper = make(chan struct{})
+	go s.reap(reapInterval)
+	return s
 }
 
 func (s *InMemStorage) Get(ctx context.Context, key string) ([]byte, error) {
-	val, ok := s.storage.Load(key)
-	if ok {
-		bval, bok := val.([]byte)
-		if bok {
-			return bval, nil
-		}
+	s.mut.RLock()
+	entry, ok := s.storage[key]
+	s.mut.RUnlock()
+	if ok && !entry.expired(time.Now()) {
+		return entry.val, nil
 	}
 	return []byte{}, nil
 }
 
 func (s *InMemStorage) Set(ctx context.Context, key string, val []byte) error {
-	s.storage.Store(key, val)
+	s.mut.Lock()
+	s.setLocked(key, &inMemEntry{val: val})
+	s.mut.Unlock()
+	return nil
+}
+
+func (s *InMemStorage) SetWithTTL(ctx context.Context, key string, val []byte,
+	ttl time.Duration) error {
+	entry := &inMemEntry{val: val}
+	if ttl > 0 {
+		entry.expiresAt = time.Now().Add(ttl)
+	}
+	s.mut.Lock()
+	s.setLocked(key, entry)
+	s.mut.Unlock()
+	return nil
+}
+
+func (s *InMemStorage) SetNX(ctx context.Context, key string, val []byte,
+	ttl time.Duration) (bool, error) {
+	entry := &inMemEntry{val: val}
+	now := time.Now()
+	if ttl > 0 {
+		entry.expiresAt = now.Add(ttl)
+	}
+	s.mut.Lock()
+	defer s.mut.Unlock()
+	if old, ok := s.storage[key]; ok && !old.expired(now) {
+		return false, nil
+	}
+	s.setLocked(key, entry)
+	return true, nil
+}
+
+func (s *InMemStorage) DelIfEqual(ctx context.Context, key string,
+	val []byte) (bool, error) {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+	entry, ok := s.storage[key]
+	if !ok || entry.expired(time.Now()) || !bytes.Equal(entry.val, val) {
+		return false, nil
+	}
+	delete(s.storage, key)
+	return true, nil
+}
+
+// setLocked sets an entry, creating the map if needed (must be called
+// with the lock held)
+func (s *InMemStorage) setLocked(key string, entry *inMemEntry) {
+	if s.storage == nil {
+		s.storage = make(map[string]*inMemEntry)
+	}
+	s.storage[key] = entry
+}
+
+// Close stops the background reaper, if any.
+func (s *InMemStorage) Close() error {
+	if s.stopReaper != nil {
+		s.stopOnce.Do(func() { close(s.stopReaper) })
+	}
 	return nil
 }
+
+// reap periodically removes the expired entries
+func (s *InMemStorage) reap(reapInterval time.Duration) {
+	ticker := time.NewTicker(reapInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case now := <-ticker.C:
+			s.mut.Lock()
+			for key, entry := range s.storage {
+				if entry.expired(now) {
+					delete(s.storage, key)
+				}
+			}
+			s.mut.Unlock()
+		case <-s.stopReaper:
+			return
+		}
+	}
+}
@@ -0,0 +1,144 @@
+package datablocks
+
+import (
+	"container/list"
+	"context"
+	"sync"
+	"time"
+)
+
+// LRUStorage is an in-memory KeyValStorage bounded by a maximum number
+// of entries and a maximum total size in bytes. When one of the limits
+// is exceeded, the least recently used entries are evicted.
+//
+// It is meant to be used as a process local cache in front of a remote
+// storage.
+type LRUStorage struct {
+	mut sync.Mutex
+
+	maxEntries int
+	maxBytes   int64
+
+	ll      *list.List // front is the most recently used
+	entries map[string]*list.Element
+	size    int64
+
+	hits      int64
+	misses    int64
+	evictions int64
+}
+
+// lruEntry is the value kept in the LRUStorage list, expiresAt is zero
+// for the entries that do not expire
+type lruEntry struct {
+	key       string
+	val       []byte
+	expiresAt time.Time
+}
+
+// size is the amount of bytes accounted for an entry
+func (e *lruEntry) size() int64 {
+	return int64(len(e.key) + len(e.val))
+}
+
+// LRUStats holds the counters of an LRUStorage
+type LRUStats struct {
+	Hits      int64
+	Misses    int64
+	Evictions int64
+
+	Entries int
+	Bytes   int64
+}
+
+// NewLRUKeyValStorage creates an LRUStorage that holds at most maxEntries
+// entries, and at most maxBytes bytes (counting keys and values).
+// A limit <= 0 means no limit for that dimension.
+func NewLRUKeyValStorage(maxEntries int, maxBytes int64) *LRUStorage {
+	return &LRUStorage{
+		maxEntries: maxEntries,
+		maxBytes:   maxBytes,
+		ll:         list.New(),
+		entries:    make(map[string]*list.Element),
+	}
+}
+
+func (s *LRUStorage) Get(ctx context.Context, key string) ([]byte, error) {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+
+	el, ok := s.entries[key]
+	if !ok {
+		s.misses += 1
+		return []byte{}, nil
+	}
+
+	entry := el.Value.(*lruEntry)
+	if !entry.expiresAt.IsZero() && !time.Now().Before(entry.expiresAt) {
+		s.removeElement(el)
+		s.misses += 1
+		return []byte{}, nil
+	}
+
+	s.ll.MoveToFront(el)
+	s.hits += 1
+	return entry.val, nil
+}
+
+func (s *LRUStorage) Set(ctx context.Context, key string, val []byte) error {
+	return s.SetWithTTL(ctx, key, val, 0)
+}
+
+func (s *LRUStorage) SetWithTTL(ctx context.Context, key string, val []byte,
+	ttl time.Duration) error {
+
+	entry := &lruEntry{key: key, val: val}
+	if ttl > 0 {
+		entry.expiresAt = time.Now().Add(ttl)
+	}
+
+	s.mut.Lock()
+	defer s.mut.Unlock()
+
+	if el, ok := s.entries[key]; ok {
+		s.removeElement(el)
+	}
+
+	if s.maxBytes > 0 && entry.size() > s.maxBytes {
+		// it would evict everything and still not fit
+		s.evictions += 1
+		return nil
+	}
+
+	s.entries[key] = s.ll.PushFront(entry)
+	s.size += entry.size()
+
+	for (s.maxEntries > 0 && s.ll.Len() > s.maxEntries) ||
+		(s.maxBytes > 0 && s.size > s.maxBytes) {
+		s.removeElement(s.ll.Back())
+		s.evictions += 1
+	}
+	return nil
+}
+
+// Stats returns a snapshot of the storage counters
+func (s *LRUStorage) Stats() LRUStats {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+
+	return LRUStats{
+		Hits:      s.hits,
+		Misses:    s.misses,
+		Evictions: s.evictions,
+		Entries:   s.ll.Len(),
+		Bytes:     s.size,
+	}
+}
+
+// removeElement removes an element from the list and the index
+// (must be called with the lock held)
+func (s *LRUStorage) removeElement(el *list.Element) {
+	entry := s.ll.Remove(el).(*lruEntry)
+	delete(s.entries, entry.key)
+	s.size -= entry.size()
+}
@@ -0,0 +1,84 @@
+package datablocks
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func Test_LRUStorageEvictsByEntries(t *testing.T) {
+	s := NewLRUKeyValStorage(2, 0)
+	ctx := context.Background()
+
+	s.Set(ctx, "a", []byte("1"))
+	s.Set(ctx, "b", []byte("2"))
+	// "a" becomes the most recently used
+	s.Get(ctx, "a")
+	s.Set(ctx, "c", []byte("3"))
+
+	val, _ := s.Get(ctx, "b")
+	if len(val) != 0 {
+		t.Errorf("b should have been evicted, got %q", val)
+		return
+	}
+	for _, k := range []string{"a", "c"} {
+		val, _ := s.Get(ctx, k)
+		if len(val) == 0 {
+			t.Errorf("%s should not have been evicted", k)
+			return
+		}
+	}
+
+	stats := s.Stats()
+	want := LRUStats{Hits: 3, Misses: 1, Evictions: 1, Entries: 2, Bytes: 4}
+	if stats != want {
+		t.Errorf("stats, want %+v, got %+v", want, stats)
+	}
+}
+
+func Test_LRUStorageEvictsBySize(t *testing.T) {
+	// each entry takes 1 byte of key + 4 bytes of value
+	s := NewLRUKeyValStorage(0, 12)
+	ctx := context.Background()
+
+	s.Set(ctx, "a", []byte("aaaa"))
+	s.Set(ctx, "b", []byte("bbbb"))
+	s.Set(ctx, "c", []byte("cccc"))
+
+	stats := s.Stats()
+	if stats.Entries != 2 || stats.Bytes != 10 || stats.Evictions != 1 {
+		t.Errorf("unexpected stats %+v", stats)
+		return
+	}
+
+	// replacing a value updates the size
+	s.Set(ctx, "c", []byte("c"))
+	if stats := s.Stats(); stats.Bytes != 7 {
+		t.Errorf("bytes, want 7, got %d", stats.Bytes)
+		return
+	}
+
+	// a value that can never fit is not stored
+	s.Set(ctx, "d", make([]byte, 20))
+	val, _ := s.Get(ctx, "d")
+	if len(val) != 0 {
+		t.Errorf("d should not be stored")
+	}
+}
+
+func Test_LRUStorageTTL(t *testing.T) {
+	s := NewLRUKeyValStorage(10, 0)
+	ctx := context.Background()
+
+	s.SetWithTTL(ctx, "a", []byte("1"), 5*time.Millisecond)
+	time.Sleep(10 * time.Millisecond)
+
+	val, err := s.Get(ctx, "a")
+	if err != nil || len(val) != 0 {
+		t.Errorf("want empty value after expiration, got %q (%v)", val, err)
+		return
+	}
+	if stats := s.Stats(); stats.Entries != 0 || stats.Misses != 1 {
+		t.Errorf("unexpected stats %+v", stats)
+	}
+}
@@ -0,0 +1,426 @@
+package datablocks
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"time"
+)
+
+const (
+	DefaultRedisAddr         string        = "localhost:6379"
+	DefaultRedisPoolSize     int           = 8
+	DefaultRedisDialTimeout  time.Duration = 500 * time.Millisecond
+	DefaultRedisReadTimeout  time.Duration = 200 * time.Millisecond
+	DefaultRedisWriteTimeout time.Duration = 200 * time.Millisecond
+)
+
+// RedisConf holds the connection parameters for a RedisKeyValStorage.
+//
+// Zero values are replaced with the defaults.
+type RedisConf struct {
+	Addr     string
+	Password string
+	DB       int
+
+	// PoolSize is the maximum number of idle connections kept
+	// around to be reused.
+	PoolSize int
+
+	DialTimeout  time.Duration
+	ReadTimeout  time.Duration
+	WriteTimeout time.Duration
+}
+
+// RedisError is an error reply sent by the redis server
+type RedisError string
+
+func (e RedisError) Error() string {
+	return string(e)
+}
+
+// RedisKeyValStorage is a KeyValStorage that talks to a redis server
+// using the RESP protocol.
+type RedisKeyValStorage struct {
+	conf RedisConf
+	pool chan *redisConn
+}
+
+// redisConn is a single connection to the redis server, with its
+// buffered reader and writer.
+type redisConn struct {
+	conn net.Conn
+	br   *bufio.Reader
+	bw   *bufio.Writer
+}
+
+// NewRedisKeyValStorage creates a redis storage. Connections are
+// not established until the first command is sent.
+func NewRedisKeyValStorage(conf RedisConf) *RedisKeyValStorage {
+	if len(conf.Addr) == 0 {
+		conf.Addr = DefaultRedisAddr
+	}
+	if conf.PoolSize <= 0 {
+		conf.PoolSize = DefaultRedisPoolSize
+	}
+	if conf.DialTimeout <= 0 {
+		conf.DialTimeout = DefaultRedisDialTimeout
+	}
+	if conf.ReadTimeout <= 0 {
+		conf.ReadTimeout = DefaultRedisReadTimeout
+	}
+	if conf.WriteTimeout <= 0 {
+		conf.WriteTimeout = DefaultRedisWriteTimeout
+	}
+	return &RedisKeyValStorage{
+		conf: conf,
+		pool: make(chan *redisConn, conf.PoolSize),
+	}
+}
+
+func (s *RedisKeyValStorage) Get(ctx context.Context, key string) ([]byte, error) {
+	reply, err := s.do(ctx, "GET", []byte(key))
+	if err != nil {
+		return nil, err
+	}
+	if reply == nil {
+		// key not found
+		return []byte{}, nil
+	}
+	b, ok := reply.([]byte)
+	if !ok {
+		return nil, fmt.Errorf("redis GET: unexpected reply %T", reply)
+	}
+	return b, nil
+}
+
+func (s *RedisKeyValStorage) Set(ctx context.Context, key string, val []byte) error {
+	reply, err := s.do(ctx, "SET", []byte(key), val)
+	if err != nil {
+		return err
+	}
+	return expectOK("SET", reply)
+}
+
+// SetWithTTL sets the key with a millisecond precision expiration (a ttl
+// under 1ms is rounded up)
+func (s *RedisKeyValStorage) SetWithTTL(ctx context.Context, key string, val []byte,
+	ttl time.Duration) error {
+	if ttl <= 0 {
+		return s.Set(ctx, key, val)
+	}
+	reply, err := s.do(ctx, "SET", []byte(key), val, []byte("PX"), pxArg(ttl))
+	if err != nil {
+		return err
+	}
+	return expectOK("SET", reply)
+}
+
+// SetNX sets the key only if it does not exist, with a millisecond
+// precision expiration (a ttl <= 0 means no expiration)
+func (s *RedisKeyValStorage) SetNX(ctx context.Context, key string, val []byte,
+	ttl time.Duration) (bool, error) {
+	args := [][]byte{[]byte(key), val, []byte("NX")}
+	if ttl > 0 {
+		args = append(args, []byte("PX"), pxArg(ttl))
+	}
+	reply, err := s.do(ctx, "SET", args...)
+	if err != nil {
+		return false, err
+	}
+	if reply == nil {
+		// the key already exists
+		return false, nil
+	}
+	return true, expectOK("SET", reply)
+}
+
+// pxArg is the PX argument for a ttl, rounded up so a sub millisecond
+// ttl does not become PX 0 (that redis rejects)
+func pxArg(ttl time.Duration) []byte {
+	ms := int64((ttl + time.Millisecond - 1) / time.Millisecond)
+	return []byte(strconv.FormatInt(ms, 10))
+}
+
+// delIfEqualScript deletes KEYS[1] if it holds ARGV[1], atomically
+const delIfEqualScript = `if redis.call("GET", KEYS[1]) == ARGV[1] then
+	return redis.call("DEL", KEYS[1])
+end
+return 0`
+
+// DelIfEqual deletes the key only if it holds val
+func (s *RedisKeyValStorage) DelIfEqual(ctx context.Context, key string,
+	val []byte) (bool, error) {
+	reply, err := s.do(ctx, "EVAL", []byte(delIfEqualScript), []byte("1"),
+		[]byte(key), val)
+	if err != nil {
+		return false, err
+	}
+	n, ok := reply.(int64)
+	if !ok {
+		return false, fmt.Errorf("redis EVAL: unexpected reply %v", reply)
+	}
+	return n > 0, nil
+}
+
+// Close closes all the idle connections. Commands sent after Close
+// will open new connections.
+func (s *RedisKeyValStorage) Close() error {
+	for {
+		select {
+		case c := <-s.pool:
+			c.conn.Close()
+		default:
+			return nil
+		}
+	}
+}
+
+// do sends a single command to the server and reads its reply. An error
+// reply from the server is returned as a RedisError.
+func (s *RedisKeyValStorage) do(ctx context.Context, cmd string,
+	args ...[]byte) (interface{}, error) {
+
+	// with a done context, the command would fail anyway, closing a
+	// healthy connection
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	c, pooled, err := s.getConn(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	reply, err := c.roundTrip(ctx, s.conf, cmd, args...)
+	var nrErr *noReplyError
+	if err != nil && pooled && errors.As(err, &nrErr) {
+		// the idle connection was closed by the server (or by something
+		// in between), so the command is sent once more on a new one
+		c.conn.Close()
+		if c, err = s.dial(ctx); err != nil {
+			return nil, err
+		}
+		reply, err = c.roundTrip(ctx, s.conf, cmd, args...)
+	}
+	if err != nil {
+		var rerr RedisError
+		if !errors.As(err, &rerr) {
+			// the connection is in an unknown state
+			c.conn.Close()
+			return nil, err
+		}
+	}
+	s.putConn(c)
+	return reply, err
+}
+
+// getConn takes an idle connection from the pool (returning true), or
+// dials a new one
+func (s *RedisKeyValStorage) getConn(ctx context.Context) (*redisConn, bool, error) {
+	select {
+	case c := <-s.pool:
+		return c, true, nil
+	default:
+	}
+	c, err := s.dial(ctx)
+	return c, false, err
+}
+
+// dial opens a new connection, authenticated and with the db selected
+func (s *RedisKeyValStorage) dial(ctx context.Context) (*redisConn, error) {
+	d := net.Dialer{Timeout: s.conf.DialTimeout}
+	conn, err := d.DialContext(ctx, "tcp", s.conf.Addr)
+	if err != nil {
+		return nil, err
+	}
+	c := &redisConn{
+		conn: conn,
+		br:   bufio.NewReader(conn),
+		bw:   bufio.NewWriter(conn),
+	}
+
+	if len(s.conf.Password) > 0 {
+		reply, err := c.roundTrip(ctx, s.conf, "AUTH", []byte(s.conf.Password))
+		if err == nil {
+			err = expectOK("AUTH", reply)
+		}
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	if s.conf.DB != 0 {
+		reply, err := c.roundTrip(ctx, s.conf, "SELECT",
+			[]byte(strconv.Itoa(s.conf.DB)))
+		if err == nil {
+			err = expectOK("SELECT", reply)
+		}
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+// putConn returns a connection to the pool, closing it if the pool is full
+func (s *RedisKeyValStorage) putConn(c *redisConn) {
+	select {
+	case s.pool <- c:
+	default:
+		c.conn.Close()
+	}
+}
+
+// roundTrip writes a command and reads its reply, using the configured
+// timeouts, or the context deadline if it comes earlier.
+func (c *redisConn) roundTrip(ctx context.Context, conf RedisConf, cmd string,
+	args ...[]byte) (interface{}, error) {
+
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	c.conn.SetWriteDeadline(deadline(ctx, conf.WriteTimeout))
+	if err := writeCommand(c.bw, cmd, args...); err != nil {
+		return nil, noReply(err)
+	}
+	if err := c.bw.Flush(); err != nil {
+		return nil, noReply(err)
+	}
+
+	c.conn.SetReadDeadline(deadline(ctx, conf.ReadTimeout))
+	if _, err := c.br.Peek(1); err != nil {
+		return nil, noReply(err)
+	}
+	return readReply(c.br)
+}
+
+// noReplyError is a connection error before any reply was read, so the
+// command can be sent again on another connection
+type noReplyError struct {
+	err error
+}
+
+func (e *noReplyError) Error() string {
+	return e.err.Error()
+}
+
+func (e *noReplyError) Unwrap() error {
+	return e.err
+}
+
+// noReply wraps err in a noReplyError, unless it is a timeout (as the
+// server could still be processing the command)
+func noReply(err error) error {
+	var nerr net.Error
+	if errors.As(err, &nerr) && nerr.Timeout() {
+		return err
+	}
+	return &noReplyError{err: err}
+}
+
+// deadline returns the earliest of now + timeout and the context deadline
+func deadline(ctx context.Context, timeout time.Duration) time.Time {
+	d := time.Now().Add(timeout)
+	if ctxDeadline, ok := ctx.Deadline(); ok && ctxDeadline.Before(d) {
+		return ctxDeadline
+	}
+	return d
+}
+
+// writeCommand encodes a command as a RESP array of bulk strings
+func writeCommand(w *bufio.Writer, cmd string, args ...[]byte) error {
+	fmt.Fprintf(w, "*%d\r\n$%d\r\n%s\r\n", len(args)+1, len(cmd), cmd)
+	for _, a := range args {
+		fmt.Fprintf(w, "$%d\r\n", len(a))
+		w.Write(a)
+		if _, err := w.WriteString("\r\n"); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// readReply decodes a single RESP reply:
+//
+//	simple strings are returned as string
+//	errors are returned as a RedisError error
+//	integers are returned as int64
+//	bulk strings are returned as []byte (nil for the null bulk string)
+//	arrays are returned as []interface{} (nil for the null array)
+func readReply(r *bufio.Reader) (interface{}, error) {
+	line, err := readLine(r)
+	if err != nil {
+		return nil, err
+	}
+	if len(line) == 0 {
+		return nil, fmt.Errorf("redis: empty reply")
+	}
+
+	switch line[0] {
+	case '+':
+		return string(line[1:]), nil
+	case '-':
+		return nil, RedisError(line[1:])
+	case ':':
+		return strconv.ParseInt(string(line[1:]), 10, 64)
+	case '$':
+		n, err := strconv.Atoi(string(line[1:]))
+		if err != nil {
+			return nil, fmt.Errorf("redis: bad bulk length: %w", err)
+		}
+		if n < 0 {
+			return nil, nil
+		}
+		b := make([]byte, n+2)
+		if _, err := io.ReadFull(r, b); err != nil {
+			return nil, err
+		}
+		return b[:n], nil
+	case '*':
+		n, err := strconv.Atoi(string(line[1:]))
+		if err != nil {
+			return nil, fmt.Errorf("redis: bad array length: %w", err)
+		}
+		if n < 0 {
+			return nil, nil
+		}
+		arr := make([]interface{}, n)
+		for i := range arr {
+			arr[i], err = readReply(r)
+			if err != nil {
+				var rerr RedisError
+				if !errors.As(err, &rerr) {
+					return nil, err
+				}
+				arr[i] = rerr
+			}
+		}
+		return arr, nil
+	}
+	return nil, fmt.Errorf("redis: unknown reply type %q", line[0])
+}
+
+// readLine reads a CRLF terminated line, without the CRLF
+func readLine(r *bufio.Reader) ([]byte, error) {
+	line, err := r.ReadSlice('\n')
+	if err != nil {
+		return nil, err
+	}
+	if len(line) < 2 || line[len(line)-2] != '\r' {
+		return nil, fmt.Errorf("redis: malformed line")
+	}
+	return line[:len(line)-2], nil
+}
+
+func expectOK(cmd string, reply interface{}) error {
+	if s, ok := reply.(string); ok && s == "OK" {
+		return nil
+	}
+	return fmt.Errorf("redis %s: unexpected reply %v", cmd, reply)
+}
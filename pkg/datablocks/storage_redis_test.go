@@ -0,0 +1,357 @@
+package datablocks
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeRedisServer is an in-process stand-in for redis that understands
+// just enough RESP to test the RedisKeyValStorage
+type fakeRedisServer struct {
+	ln       net.Listener
+	password string
+
+	mut      sync.Mutex
+	data     map[int]map[string]*fakeRedisEntry
+	numConns int
+	conns    []net.Conn
+}
+
+type fakeRedisEntry struct {
+	val       []byte
+	expiresAt time.Time
+}
+
+// get returns the entry for a key, if it exists and has not expired
+// (must be called with the lock held)
+func (s *fakeRedisServer) get(db int, key string) (*fakeRedisEntry, bool) {
+	e, ok := s.data[db][key]
+	if !ok || (!e.expiresAt.IsZero() && !time.Now().Before(e.expiresAt)) {
+		return nil, false
+	}
+	return e, true
+}
+
+func newFakeRedisServer(t *testing.T, password string) *fakeRedisServer {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("cannot listen: %s", err.Error())
+	}
+	s := &fakeRedisServer{
+		ln:       ln,
+		password: password,
+		data:     map[int]map[string]*fakeRedisEntry{},
+	}
+	go s.serve()
+	t.Cleanup(func() { ln.Close() })
+	return s
+}
+
+func (s *fakeRedisServer) Addr() string {
+	return s.ln.Addr().String()
+}
+
+func (s *fakeRedisServer) serve() {
+	for {
+		conn, err := s.ln.Accept()
+		if err != nil {
+			return
+		}
+		s.mut.Lock()
+		s.numConns += 1
+		s.conns = append(s.conns, conn)
+		s.mut.Unlock()
+		go s.serveConn(conn)
+	}
+}
+
+// closeConns closes the open connections, as redis does with the idle
+// ones after its timeout
+func (s *fakeRedisServer) closeConns() {
+	s.mut.Lock()
+	for _, conn := range s.conns {
+		conn.Close()
+	}
+	s.conns = nil
+	s.mut.Unlock()
+}
+
+func (s *fakeRedisServer) serveConn(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	authed := len(s.password) == 0
+	db := 0
+	for {
+		reply, err := readReply(r)
+		if err != nil {
+			return
+		}
+		args, ok := reply.([]interface{})
+		if !ok || len(args) == 0 {
+			return
+		}
+		cmd := strings.ToUpper(string(args[0].([]byte)))
+		if !authed && cmd != "AUTH" {
+			io.WriteString(conn, "-NOAUTH Authentication required.\r\n")
+			continue
+		}
+		switch cmd {
+		case "AUTH":
+			if string(args[1].([]byte)) != s.password {
+				io.WriteString(conn, "-WRONGPASS invalid password\r\n")
+				continue
+			}
+			authed = true
+			io.WriteString(conn, "+OK\r\n")
+		case "SELECT":
+			db, _ = strconv.Atoi(string(args[1].([]byte)))
+			io.WriteString(conn, "+OK\r\n")
+		case "GET":
+			s.mut.Lock()
+			e, found := s.get(db, string(args[1].([]byte)))
+			s.mut.Unlock()
+			if !found {
+				io.WriteString(conn, "$-1\r\n")
+				continue
+			}
+			fmt.Fprintf(conn, "$%d\r\n%s\r\n", len(e.val), e.val)
+		case "SET":
+			e := &fakeRedisEntry{val: args[2].([]byte)}
+			nx := false
+			for i := 3; i < len(args); i++ {
+				switch strings.ToUpper(string(args[i].([]byte))) {
+				case "PX":
+					ms, _ := strconv.Atoi(string(args[i+1].([]byte)))
+					e.expiresAt = time.Now().Add(time.Duration(ms) * time.Millisecond)
+					i++
+				case "NX":
+					nx = true
+				}
+			}
+			key := string(args[1].([]byte))
+			s.mut.Lock()
+			if _, found := s.get(db, key); nx && found {
+				s.mut.Unlock()
+				io.WriteString(conn, "$-1\r\n")
+				continue
+			}
+			if s.data[db] == nil {
+				s.data[db] = map[string]*fakeRedisEntry{}
+			}
+			s.data[db][key] = e
+			s.mut.Unlock()
+			io.WriteString(conn, "+OK\r\n")
+		case "EVAL":
+			// the only script we use is the one of DelIfEqual
+			key := string(args[3].([]byte))
+			s.mut.Lock()
+			e, found := s.get(db, key)
+			deleted := 0
+			if found && bytes.Equal(e.val, args[4].([]byte)) {
+				delete(s.data[db], key)
+				deleted = 1
+			}
+			s.mut.Unlock()
+			fmt.Fprintf(conn, ":%d\r\n", deleted)
+		default:
+			fmt.Fprintf(conn, "-ERR unknown command '%s'\r\n", cmd)
+		}
+	}
+}
+
+func Test_RedisStorageGetSet(t *testing.T) {
+	srv := newFakeRedisServer(t, "")
+	s := NewRedisKeyValStorage(RedisConf{Addr: srv.Addr(), PoolSize: 2})
+	defer s.Close()
+
+	ctx := context.Background()
+	val, err := s.Get(ctx, "missing")
+	if err != nil {
+		t.Errorf("unexpected error %s", err.Error())
+		return
+	}
+	if val == nil || len(val) != 0 {
+		t.Errorf("missing key, want empty bytes, got %#v", val)
+		return
+	}
+
+	// binary safe values
+	want := []byte("a\r\nb\x00c")
+	if err := s.Set(ctx, "foo", want); err != nil {
+		t.Errorf("unexpected error %s", err.Error())
+		return
+	}
+	val, err = s.Get(ctx, "foo")
+	if err != nil {
+		t.Errorf("unexpected error %s", err.Error())
+		return
+	}
+	if !bytes.Equal(val, want) {
+		t.Errorf("want %q, got %q", want, val)
+		return
+	}
+
+	// connections are reused
+	srv.mut.Lock()
+	numConns := srv.numConns
+	srv.mut.Unlock()
+	if numConns != 1 {
+		t.Errorf("connections, want 1, got %d", numConns)
+	}
+}
+
+func Test_RedisStorageAuthAndDB(t *testing.T) {
+	srv := newFakeRedisServer(t, "secret")
+	ctx := context.Background()
+
+	bad := NewRedisKeyValStorage(RedisConf{Addr: srv.Addr(), Password: "wrong"})
+	_, err := bad.Get(ctx, "foo")
+	var rerr RedisError
+	if !errors.As(err, &rerr) {
+		t.Errorf("want a RedisError, got %v", err)
+		return
+	}
+
+	s := NewRedisKeyValStorage(RedisConf{Addr: srv.Addr(), Password: "secret", DB: 3})
+	defer s.Close()
+	if err := s.Set(ctx, "foo", []byte("bar")); err != nil {
+		t.Errorf("unexpected error %s", err.Error())
+		return
+	}
+
+	srv.mut.Lock()
+	e, ok := srv.get(3, "foo")
+	srv.mut.Unlock()
+	if !ok || string(e.val) != "bar" {
+		t.Errorf("want value stored in db 3")
+	}
+}
+
+func Test_RedisStorageSetWithTTL(t *testing.T) {
+	srv := newFakeRedisServer(t, "")
+	s := NewRedisKeyValStorage(RedisConf{Addr: srv.Addr()})
+	defer s.Close()
+
+	ctx := context.Background()
+	if err := s.SetWithTTL(ctx, "foo", []byte("bar"), 20*time.Millisecond); err != nil {
+		t.Errorf("unexpected error %s", err.Error())
+		return
+	}
+	val, _ := s.Get(ctx, "foo")
+	if string(val) != "bar" {
+		t.Errorf("want bar before expiration, got %q", val)
+		return
+	}
+
+	time.Sleep(30 * time.Millisecond)
+	val, err := s.Get(ctx, "foo")
+	if err != nil || len(val) != 0 {
+		t.Errorf("want empty value after expiration, got %q (%v)", val, err)
+	}
+}
+
+func Test_RedisStoragePX(t *testing.T) {
+	for _, tc := range []struct {
+		ttl  time.Duration
+		want string
+	}{
+		{ttl: time.Microsecond, want: "1"},
+		{ttl: time.Millisecond, want: "1"},
+		{ttl: 1500 * time.Microsecond, want: "2"},
+		{ttl: time.Second, want: "1000"},
+	} {
+		if got := string(pxArg(tc.ttl)); got != tc.want {
+			t.Errorf("PX for %s, want %s, got %s", tc.ttl, tc.want, got)
+			return
+		}
+	}
+}
+
+func Test_RedisStorageCancelledContext(t *testing.T) {
+	srv := newFakeRedisServer(t, "")
+	s := NewRedisKeyValStorage(RedisConf{Addr: srv.Addr()})
+	defer s.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := s.Get(ctx, "foo"); err == nil {
+		t.Errorf("want an error with a cancelled context")
+	}
+}
+
+func Test_RedisStorageClosedIdleConn(t *testing.T) {
+	srv := newFakeRedisServer(t, "")
+	s := NewRedisKeyValStorage(RedisConf{Addr: srv.Addr()})
+	defer s.Close()
+
+	ctx := context.Background()
+	if err := s.Set(ctx, "foo", []byte("bar")); err != nil {
+		t.Errorf("unexpected error %s", err.Error())
+		return
+	}
+
+	// a cancelled context does not close the pooled connection
+	cancelled, cancel := context.WithCancel(ctx)
+	cancel()
+	s.Get(cancelled, "foo")
+	if _, err := s.Get(ctx, "foo"); err != nil {
+		t.Errorf("unexpected error %s", err.Error())
+		return
+	}
+	srv.mut.Lock()
+	numConns := srv.numConns
+	srv.mut.Unlock()
+	if numConns != 1 {
+		t.Errorf("connections, want 1, got %d", numConns)
+		return
+	}
+
+	// the command is sent again on a new connection
+	srv.closeConns()
+	time.Sleep(5 * time.Millisecond)
+	val, err := s.Get(ctx, "foo")
+	if err != nil || string(val) != "bar" {
+		t.Errorf("want bar, got %q (%v)", val, err)
+	}
+}
+
+func Test_RedisStorageLocks(t *testing.T) {
+	srv := newFakeRedisServer(t, "")
+	s := NewRedisKeyValStorage(RedisConf{Addr: srv.Addr()})
+	defer s.Close()
+	testLockStorage(t, s)
+}
+
+// Test_RedisStorageLocalServer runs against a real redis server when
+// DATABLOCKS_REDIS_ADDR is set (i.e: DATABLOCKS_REDIS_ADDR=localhost:6379)
+func Test_RedisStorageLocalServer(t *testing.T) {
+	addr := os.Getenv("DATABLOCKS_REDIS_ADDR")
+	if len(addr) == 0 {
+		t.Skip("DATABLOCKS_REDIS_ADDR not set")
+	}
+	s := NewRedisKeyValStorage(RedisConf{Addr: addr})
+	defer s.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	key := fmt.Sprintf("datablocks_test_%d", time.Now().UnixNano())
+	if err := s.Set(ctx, key, []byte("bar")); err != nil {
+		t.Errorf("unexpected error %s", err.Error())
+		return
+	}
+	val, err := s.Get(ctx, key)
+	if err != nil || string(val) != "bar" {
+		t.Errorf("want bar, got %q (%v)", val, err)
+	}
+}
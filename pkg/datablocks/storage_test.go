@@ -0,0 +1,107 @@
+package datablocks
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func Test_InMemStorageTTL(t *testing.T) {
+	s := NewInMemKeyValStorage()
+	ctx := context.Background()
+
+	s.Set(ctx, "forever", []byte("a"))
+	s.SetWithTTL(ctx, "short", []byte("b"), 10*time.Millisecond)
+
+	val, _ := s.Get(ctx, "short")
+	if string(val) != "b" {
+		t.Errorf("want b before expiration, got %q", val)
+		return
+	}
+
+	time.Sleep(15 * time.Millisecond)
+	val, err := s.Get(ctx, "short")
+	if err != nil || val == nil || len(val) != 0 {
+		t.Errorf("want empty value after expiration, got %#v (%v)", val, err)
+		return
+	}
+	val, _ = s.Get(ctx, "forever")
+	if string(val) != "a" {
+		t.Errorf("want a for the key without ttl, got %q", val)
+	}
+}
+
+func Test_InMemStorageReaper(t *testing.T) {
+	s := NewInMemKeyValStorageWithReaper(5 * time.Millisecond)
+	defer s.Close()
+	ctx := context.Background()
+
+	s.SetWithTTL(ctx, "short", []byte("b"), time.Millisecond)
+	s.SetWithTTL(ctx, "long", []byte("c"), time.Minute)
+
+	time.Sleep(20 * time.Millisecond)
+	s.mut.RLock()
+	_, shortFound := s.storage["short"]
+	_, longFound := s.storage["long"]
+	s.mut.RUnlock()
+	if shortFound {
+		t.Errorf("expired entry should have been reaped")
+	}
+	if !longFound {
+		t.Errorf("entry not expired should not have been reaped")
+	}
+}
+
+// testLockStorage checks the lock operations of a LockKeyValStorage
+func testLockStorage(t *testing.T, s LockKeyValStorage) {
+	ctx := context.Background()
+
+	ok, err := s.SetNX(ctx, "lock", []byte("owner"), 20*time.Millisecond)
+	if err != nil || !ok {
+		t.Errorf("want the lock acquired, got %v (%v)", ok, err)
+		return
+	}
+	if ok, _ := s.SetNX(ctx, "lock", []byte("other"), time.Second); ok {
+		t.Errorf("the lock should be held")
+		return
+	}
+	if ok, _ := s.DelIfEqual(ctx, "lock", []byte("other")); ok {
+		t.Errorf("the lock should only be released by its owner")
+		return
+	}
+	if ok, err := s.DelIfEqual(ctx, "lock", []byte("owner")); err != nil || !ok {
+		t.Errorf("want the lock released, got %v (%v)", ok, err)
+		return
+	}
+
+	// an expired lock can be acquired again
+	s.SetNX(ctx, "lock", []byte("owner"), 5*time.Millisecond)
+	time.Sleep(10 * time.Millisecond)
+	if ok, _ := s.SetNX(ctx, "lock", []byte("other"), time.Second); !ok {
+		t.Errorf("want the expired lock acquired")
+	}
+}
+
+func Test_InMemStorageLocks(t *testing.T) {
+	testLockStorage(t, NewInMemKeyValStorage())
+}
+
+func Test_InMemStorageZeroValue(t *testing.T) {
+	var s InMemStorage
+	ctx := context.Background()
+	if val, err := s.Get(ctx, "foo"); err != nil || len(val) != 0 {
+		t.Errorf("want an empty value, got %q (%v)", val, err)
+		return
+	}
+	s.Set(ctx, "foo", []byte("bar"))
+	if val, _ := s.Get(ctx, "foo"); string(val) != "bar" {
+		t.Errorf("want bar, got %q", val)
+		return
+	}
+	testLockStorage(t, &InMemStorage{})
+
+	// a non positive reap interval uses the default one
+	r := NewInMemKeyValStorageWithReaper(0)
+	time.Sleep(time.Millisecond)
+	r.Close()
+}
@@ -0,0 +1,215 @@
+package datablocks
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultWriteBehindQueueSize int           = 256
+	DefaultWriteBehindTimeout   time.Duration = time.Second
+	DefaultBackfillTTL          time.Duration = time.Minute
+)
+
+// TieredConf holds the configuration for a TieredStorage.
+type TieredConf struct {
+	// BackfillTTL is the expiration used when a value found in the remote
+	// tier is copied to the local one, and the maximum one for the values
+	// written to the local tier (DefaultBackfillTTL if 0, and no expiration
+	// if < 0). It should be kept short, as the local tier does not know
+	// when the remote value changes or expires.
+	BackfillTTL time.Duration
+
+	// WriteBehind makes Set return as soon as the local tier is written,
+	// queueing the write to the remote tier to be done in background.
+	// When the queue is full, the remote write is done synchronously.
+	WriteBehind          bool
+	WriteBehindQueueSize int
+	// WriteBehindTimeout is the maximum time for each background write
+	WriteBehindTimeout time.Duration
+}
+
+// TieredStorage is a KeyValStorage composed of a local (L1) storage,
+// usually an LRUStorage, in front of a remote (L2) one.
+//
+// Reads hit the local tier first, and fall through to the remote one,
+// backfilling the local tier with the found value. Writes go to both.
+// The locks (see LockKeyValStorage) are held in the remote tier, and fail
+// with ErrLocksNotSupported when it does not implement them.
+type TieredStorage struct {
+	local  KeyValStorage
+	remote KeyValStorage
+	conf   TieredConf
+
+	// queue and closed are only used in write behind mode
+	queueMut     sync.RWMutex
+	queue        chan tieredWrite
+	closed       bool
+	workerDoneCh chan struct{}
+}
+
+// tieredWrite is a write to the remote tier pending to be done
+type tieredWrite struct {
+	key string
+	val []byte
+	ttl time.Duration
+}
+
+// NewTieredKeyValStorage creates a TieredStorage. When conf.WriteBehind
+// is set, Close must be called to flush the pending writes.
+func NewTieredKeyValStorage(local, remote KeyValStorage, conf TieredConf) *TieredStorage {
+	s := &TieredStorage{
+		local:  local,
+		remote: remote,
+		conf:   conf,
+	}
+	if s.conf.BackfillTTL == 0 {
+		s.conf.BackfillTTL = DefaultBackfillTTL
+	}
+
+	if conf.WriteBehind {
+		if s.conf.WriteBehindQueueSize <= 0 {
+			s.conf.WriteBehindQueueSize = DefaultWriteBehindQueueSize
+		}
+		if s.conf.WriteBehindTimeout <= 0 {
+			s.conf.WriteBehindTimeout = DefaultWriteBehindTimeout
+		}
+		s.queue = make(chan tieredWrite, s.conf.WriteBehindQueueSize)
+		s.workerDoneCh = make(chan struct{})
+		go s.writeBehindWorker()
+	}
+	return s
+}
+
+func (s *TieredStorage) Get(ctx context.Context, key string) ([]byte, error) {
+	val, err := s.local.Get(ctx, key)
+	if err == nil && len(val) > 0 {
+		return val, nil
+	}
+	// TODO: log the local error, if any
+
+	val, err = s.remote.Get(ctx, key)
+	if err != nil || len(val) == 0 {
+		return val, err
+	}
+
+	err = setWithTTL(ctx, s.local, key, val, s.conf.BackfillTTL)
+	if err != nil {
+		// TODO: log and continue, the value is still valid
+	}
+	return val, nil
+}
+
+func (s *TieredStorage) Set(ctx context.Context, key string, val []byte) error {
+	return s.SetWithTTL(ctx, key, val, 0)
+}
+
+// SetWithTTL writes to both tiers, using the ttl for the tiers that
+// implement TTLKeyValStorage.
+func (s *TieredStorage) SetWithTTL(ctx context.Context, key string, val []byte,
+	ttl time.Duration) error {
+
+	localTTL := ttl
+	if s.conf.BackfillTTL > 0 && (localTTL <= 0 || s.conf.BackfillTTL < localTTL) {
+		localTTL = s.conf.BackfillTTL
+	}
+	if err := setWithTTL(ctx, s.local, key, val, localTTL); err != nil {
+		// TODO: log and continue, the remote tier is the reference
+	}
+
+	if s.conf.WriteBehind && s.enqueue(tieredWrite{key: key, val: val, ttl: ttl}) {
+		return nil
+	}
+	return setWithTTL(ctx, s.remote, key, val, ttl)
+}
+
+// SetNX sets the key in the remote tier only if it does not exist there,
+// as the local tier is not shared with the other processes. It fails with
+// ErrLocksNotSupported if the remote tier does not implement
+// LockKeyValStorage.
+func (s *TieredStorage) SetNX(ctx context.Context, key string, val []byte,
+	ttl time.Duration) (bool, error) {
+
+	lockStorage, ok := s.remote.(LockKeyValStorage)
+	if !ok {
+		return false, ErrLocksNotSupported
+	}
+	return lockStorage.SetNX(ctx, key, val, ttl)
+}
+
+// DelIfEqual deletes the key from the remote tier only if it holds val
+// (see SetNX).
+func (s *TieredStorage) DelIfEqual(ctx context.Context, key string,
+	val []byte) (bool, error) {
+
+	lockStorage, ok := s.remote.(LockKeyValStorage)
+	if !ok {
+		return false, ErrLocksNotSupported
+	}
+	return lockStorage.DelIfEqual(ctx, key, val)
+}
+
+func (s *TieredStorage) supportsLocks() bool {
+	return supportsLocks(s.remote)
+}
+
+// Close flushes the pending background writes, and waits for them
+// to finish.
+func (s *TieredStorage) Close() error {
+	if !s.conf.WriteBehind {
+		return nil
+	}
+
+	s.queueMut.Lock()
+	if !s.closed {
+		s.closed = true
+		close(s.queue)
+	}
+	s.queueMut.Unlock()
+
+	<-s.workerDoneCh
+	return nil
+}
+
+// enqueue queues a write to the remote tier, returning false if it
+// could not be queued (because the queue is full or closed)
+func (s *TieredStorage) enqueue(w tieredWrite) bool {
+	s.queueMut.RLock()
+	defer s.queueMut.RUnlock()
+
+	if s.closed {
+		return false
+	}
+	select {
+	case s.queue <- w:
+		return true
+	default:
+		return false
+	}
+}
+
+// writeBehindWorker writes the queued values to the remote tier
+func (s *TieredStorage) writeBehindWorker() {
+	defer close(s.workerDoneCh)
+	for w := range s.queue {
+		ctx, cancel := context.WithTimeout(context.Background(),
+			s.conf.WriteBehindTimeout)
+		err := setWithTTL(ctx, s.remote, w.key, w.val, w.ttl)
+		cancel()
+		if err != nil {
+			// TODO: log the error
+		}
+	}
+}
+
+// setWithTTL uses SetWithTTL when the storage implements it and there is
+// a ttl, and Set otherwise.
+func setWithTTL(ctx context.Context, storage KeyValStorage, key string,
+	val []byte, ttl time.Duration) error {
+
+	if ttlStorage, ok := storage.(TTLKeyValStorage); ok && ttl > 0 {
+		return ttlStorage.SetWithTTL(ctx, key, val, ttl)
+	}
+	return storage.Set(ctx, key, val)
+}
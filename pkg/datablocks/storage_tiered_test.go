@@ -0,0 +1,157 @@
+package datablocks
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+// countingStorage counts the calls made to the wrapped storage
+type countingStorage struct {
+	KeyValStorage
+	gets chan string
+	sets chan string
+}
+
+func newCountingStorage(s KeyValStorage) *countingStorage {
+	return &countingStorage{
+		KeyValStorage: s,
+		gets:          make(chan string, 16),
+		sets:          make(chan string, 16),
+	}
+}
+
+func (s *countingStorage) Get(ctx context.Context, key string) ([]byte, error) {
+	s.gets <- key
+	return s.KeyValStorage.Get(ctx, key)
+}
+
+func (s *countingStorage) Set(ctx context.Context, key string, val []byte) error {
+	s.sets <- key
+	return s.KeyValStorage.Set(ctx, key, val)
+}
+
+func Test_TieredStorageReadThrough(t *testing.T) {
+	local := NewLRUKeyValStorage(10, 0)
+	remote := newCountingStorage(NewInMemKeyValStorage())
+	s := NewTieredKeyValStorage(local, remote, TieredConf{})
+	ctx := context.Background()
+
+	remote.KeyValStorage.Set(ctx, "foo", []byte("bar"))
+
+	for i := 0; i < 3; i++ {
+		val, err := s.Get(ctx, "foo")
+		if err != nil || string(val) != "bar" {
+			t.Errorf("want bar, got %q (%v)", val, err)
+			return
+		}
+	}
+	if len(remote.gets) != 1 {
+		t.Errorf("remote gets, want 1, got %d", len(remote.gets))
+		return
+	}
+
+	val, err := s.Get(ctx, "missing")
+	if err != nil || val == nil || len(val) != 0 {
+		t.Errorf("want empty value for a missing key, got %#v (%v)", val, err)
+	}
+}
+
+func Test_TieredStorageWriteBehind(t *testing.T) {
+	local := NewLRUKeyValStorage(10, 0)
+	remote := newCountingStorage(NewInMemKeyValStorage())
+	s := NewTieredKeyValStorage(local, remote, TieredConf{WriteBehind: true})
+	ctx := context.Background()
+
+	if err := s.SetWithTTL(ctx, "foo", []byte("bar"), time.Minute); err != nil {
+		t.Errorf("unexpected error %s", err.Error())
+		return
+	}
+	val, _ := local.Get(ctx, "foo")
+	if string(val) != "bar" {
+		t.Errorf("local tier should be written synchronously")
+		return
+	}
+
+	s.Close()
+	val, _ = remote.KeyValStorage.Get(ctx, "foo")
+	if string(val) != "bar" {
+		t.Errorf("remote tier should be written after close, got %q", val)
+		return
+	}
+
+	// after close, writes are synchronous
+	s.Set(ctx, "foo2", []byte("bar2"))
+	val, _ = remote.KeyValStorage.Get(ctx, "foo2")
+	if string(val) != "bar2" {
+		t.Errorf("remote tier should be written after close, got %q", val)
+	}
+}
+
+func Test_TieredStorageLocks(t *testing.T) {
+	local := NewInMemKeyValStorage()
+	remote := NewInMemKeyValStorage()
+	s := NewTieredKeyValStorage(local, remote, TieredConf{})
+	ctx := context.Background()
+
+	if ok, err := s.SetNX(ctx, "lock", []byte("a"), time.Minute); !ok || err != nil {
+		t.Errorf("want the lock, got %t (%v)", ok, err)
+		return
+	}
+	// the lock is held in the remote tier only
+	if val, _ := local.Get(ctx, "lock"); len(val) > 0 {
+		t.Errorf("the lock should not be in the local tier")
+		return
+	}
+	if ok, _ := remote.SetNX(ctx, "lock", []byte("b"), time.Minute); ok {
+		t.Errorf("the lock should be held in the remote tier")
+		return
+	}
+	if ok, err := s.DelIfEqual(ctx, "lock", []byte("a")); !ok || err != nil {
+		t.Errorf("want the lock released, got %t (%v)", ok, err)
+		return
+	}
+
+	s = NewTieredKeyValStorage(local, NewNopKeyValStorage(), TieredConf{})
+	if _, err := s.SetNX(ctx, "lock", []byte("a"), time.Minute); err != ErrLocksNotSupported {
+		t.Errorf("want ErrLocksNotSupported, got %v", err)
+	}
+}
+
+func Test_TieredStorageDefaultBackfillTTL(t *testing.T) {
+	for _, tc := range []struct {
+		backfillTTL time.Duration
+		wantTTL     time.Duration
+	}{
+		{backfillTTL: 0, wantTTL: DefaultBackfillTTL},
+		{backfillTTL: 10 * time.Second, wantTTL: 10 * time.Second},
+		{backfillTTL: -1, wantTTL: 0},
+	} {
+		local := NewInMemKeyValStorage()
+		remote := NewInMemKeyValStorage()
+		s := NewTieredKeyValStorage(local, remote, TieredConf{BackfillTTL: tc.backfillTTL})
+		ctx := context.Background()
+		remote.Set(ctx, "foo", []byte("bar"))
+
+		start := time.Now()
+		s.Get(ctx, "foo")
+		local.mut.RLock()
+		entry := local.storage["foo"]
+		local.mut.RUnlock()
+		if entry == nil {
+			t.Errorf("backfill %s: want a backfilled value", tc.backfillTTL)
+			return
+		}
+		if tc.wantTTL == 0 && !entry.expiresAt.IsZero() {
+			t.Errorf("backfill %s: want no expiration, got %v", tc.backfillTTL,
+				entry.expiresAt)
+			return
+		}
+		if ttl := entry.expiresAt.Sub(start); tc.wantTTL > 0 &&
+			(ttl < tc.wantTTL || ttl > tc.wantTTL+time.Second) {
+			t.Errorf("backfill %s: want a ttl of %s, got %s", tc.backfillTTL,
+				tc.wantTTL, ttl)
+			return
+		}
+	}
+}
@@ -0,0 +1,90 @@
+package datablocks
+
+import (
+	"context"
+	"fmt"
+)
+
+// FetchReq is an AsyncFetchReq for a fetcher that returns a T, so its
+// result can be retrieved without casting (see WaitFor).
+//
+// The embedded AsyncFetchReq can be used with the untyped DataFetcher
+// API as usual.
+type FetchReq[T any] struct {
+	AsyncFetchReq
+}
+
+// NewFetchReq creates a typed fetch request, with hash identifying the
+// data to fetch (see AsyncFetchReq).
+func NewFetchReq[T any](hash string,
+	fetcher func(ctx context.Context) (T, error)) *FetchReq[T] {
+
+	return &FetchReq[T]{
+		AsyncFetchReq: AsyncFetchReq{
+			Fetcher: func(ctx context.Context) (interface{}, error) {
+				return fetcher(ctx)
+			},
+			Hash: hash,
+		},
+	}
+}
+
+// WaitFor launches a typed fetch request and waits for its result.
+// The error is either the error waiting for the data, or the error
+// returned by the fetcher.
+func WaitFor[T any](ctx context.Context, df DataFetcher, req *FetchReq[T]) (T, error) {
+	d, err := df.WaitForFetch(ctx, &req.AsyncFetchReq)
+	if err != nil {
+		var zero T
+		return zero, err
+	}
+	if d.Err != nil {
+		var zero T
+		return zero, d.Err
+	}
+	return ResultAs[T](d)
+}
+
+// ResultAs casts the result of a fetch to T. A nil result is returned as
+// the zero value of T.
+func ResultAs[T any](d *AsyncFetchData) (T, error) {
+	var zero T
+	if d == nil {
+		return zero, fmt.Errorf("cannot cast nil value")
+	}
+	if d.Result == nil {
+		return zero, nil
+	}
+	out, ok := d.Result.(T)
+	if !ok {
+		return zero, fmt.Errorf("cannot cast %T to %T for %s", d.Result, zero, d.Hash)
+	}
+	return out, nil
+}
+
+// NewResultOf returns a function to be used as NodeConf.NewResult for
+// a node builder that returns a T.
+func NewResultOf[T any]() func() interface{} {
+	return func() interface{} {
+		var zero T
+		return zero
+	}
+}
+
+// Dependency returns the result of one of the dependencies of a node
+// (see DependencyResult) cast to T.
+func Dependency[T any](ctx context.Context, key string) (T, error) {
+	var zero T
+	res, ok := DependencyResult(ctx, key)
+	if !ok {
+		return zero, fmt.Errorf("missing dependency %s", key)
+	}
+	if res == nil {
+		return zero, nil
+	}
+	out, ok := res.(T)
+	if !ok {
+		return zero, fmt.Errorf("cannot cast %T to %T for dependency %s", res, zero, key)
+	}
+	return out, nil
+}
@@ -0,0 +1,50 @@
+package datablocks
+
+import (
+	"context"
+	"fmt"
+	"testing"
+)
+
+func Test_TypedFetch(t *testing.T) {
+	df := NewDataFetcherImpl(10)
+	ctx := context.Background()
+
+	req := NewFetchReq("TypedItem_1", func(ctx context.Context) (*testCodecItem, error) {
+		return &testCodecItem{Name: "book", Count: 1}, nil
+	})
+	item, err := WaitFor(ctx, df, req)
+	if err != nil {
+		t.Errorf("unexpected error %s", err.Error())
+		return
+	}
+	if item.Name != "book" {
+		t.Errorf("want book, got %s", item.Name)
+		return
+	}
+
+	// the fetcher error is returned
+	failing := NewFetchReq("TypedItem_2", func(ctx context.Context) (int, error) {
+		return 0, fmt.Errorf("failed")
+	})
+	if _, err := WaitFor(ctx, df, failing); err == nil {
+		t.Errorf("want an error")
+		return
+	}
+
+	// requesting a hash already fetched with another type
+	wrongType := NewFetchReq("TypedItem_1", func(ctx context.Context) (string, error) {
+		return "", nil
+	})
+	if _, err := WaitFor(ctx, df, wrongType); err == nil {
+		t.Errorf("want a cast error")
+	}
+}
+
+func Test_NewResultOf(t *testing.T) {
+	b, _ := JSONCodec{}.Marshal(&testCodecItem{Name: "book", Count: 2})
+	val, err := decodeNodeResult(JSONCodec{}, b, NewResultOf[*testCodecItem]())
+	if item, ok := val.(*testCodecItem); !ok || item.Name != "book" || err != nil {
+		t.Errorf("want a *testCodecItem, got %#v (%v)", val, err)
+	}
+}